@@ -33,14 +33,110 @@ const (
 	VerbatimMacro
 )
 
+// Position describes a location within a GSP source document.  A
+// Position with a Line of 0 is invalid, and is used for nodes and
+// attributes that did not originate from source text.
+type Position struct {
+	// Offset is the byte offset of the position, starting at 0.
+	Offset int
+	// Line is the line number, starting at 1.
+	Line int
+	// Column is the column number in characters, starting at 1.
+	Column int
+}
+
+// IsValid reports whether the position refers to a location in the
+// source.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// Span describes the half-open range of source text between Start
+// and End.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// BodyKind represents the manner in which a node body was opened.
+type BodyKind int
+
+const (
+	// NodeBody represents a body opened with ‘{’, containing child
+	// nodes or raw text.
+	NodeBody BodyKind = iota
+	// TrimmedTextBody represents a text body opened with ‘{-’.
+	TrimmedTextBody
+	// UntrimmedTextBody represents a text body opened with ‘{=’.
+	UntrimmedTextBody
+)
+
+// AttributeForm represents the syntax with which an attribute was
+// written.
+type AttributeForm int
+
+const (
+	// QuotedAttribute represents an attribute of the form
+	// ‘key="value"’.
+	QuotedAttribute AttributeForm = iota
+	// BareAttribute represents an attribute given without a value.
+	BareAttribute
+	// IDShorthand represents an ID given as ‘#value’.
+	IDShorthand
+	// ClassShorthand represents a class given as ‘.value’.
+	ClassShorthand
+)
+
+// AttributeTrivia records how a single attribute was written.
+type AttributeTrivia struct {
+	// Leading holds the whitespace preceding the attribute.
+	Leading string
+	// Form specifies the syntax used to write the attribute.
+	Form AttributeForm
+	// Value holds the value of the attribute as it was parsed, such
+	// that modified attributes can be detected.
+	Value string
+	// Raw holds the value of a QuotedAttribute exactly as written
+	// between the quotes, including any escape sequences.
+	Raw string
+}
+
+// Trivia records the syntactic details of a node which do not affect
+// its meaning, allowing the node to be written back exactly as it
+// appeared in the source.
+type Trivia struct {
+	// Leading holds the whitespace preceding the node.  For the first
+	// text node of a trimmed text body, it holds the whitespace that
+	// was trimmed.
+	Leading string
+	// BeforeBody holds the whitespace preceding the node body.
+	BeforeBody string
+	// Body specifies how the node body was opened.
+	Body BodyKind
+	// Trailing holds the whitespace preceding the closing brace of the
+	// node body.  For trimmed text bodies, it holds the whitespace that
+	// was trimmed.
+	Trailing string
+	// After holds the whitespace following the node.  It is only
+	// recorded for the last node of a document.
+	After string
+}
+
 // Node represents a single element in a GSP AST.
 type Node struct {
 	// Type specifies this node’s type.
 	Type NodeType
 	// Name holds this node’s tag name, macro name, or text content depending on the Type.
 	Name string
-	// Attributes contains this node’s attributes mapping keys to slices of values.
-	Attributes map[string][]string
+	// Attributes contains this node’s attributes in source order.
+	Attributes Attributes
 	// Children contains this node’s descendant nodes.
 	Children []Node
+	// Span is the source range from which this node was parsed.  For
+	// text nodes in a trimmed text body the span excludes the
+	// trimmed whitespace.
+	Span Span
+	// Trivia records the syntactic details of this node.  It is nil
+	// unless requested from the parser.
+	Trivia *Trivia
 }
@@ -0,0 +1,124 @@
+package ast
+
+import (
+	"iter"
+	"slices"
+	"strings"
+)
+
+// Attribute represents a single attribute of a node.
+type Attribute struct {
+	// Key holds the attribute name.  Shorthand IDs and classes have
+	// the keys ‘id’ and ‘class’.
+	Key string
+	// Value holds the attribute value, which is empty for attributes
+	// provided without a value.
+	Value string
+	// KeySpan spans the attribute name, or the ‘#’ or ‘.’ of an ID or
+	// class shorthand.
+	KeySpan Span
+	// ValueSpan spans the attribute value including any surrounding
+	// quotes.  ValueSpan is the zero Span for attributes provided
+	// without a value.
+	ValueSpan Span
+	// Trivia records how the attribute was written.  It is nil unless
+	// requested from the parser.
+	Trivia *AttributeTrivia
+}
+
+// Attributes holds the attributes of a node in the order in which
+// they were given.  A key may occur more than once, in which case the
+// attribute conventionally takes all of its values joined by spaces,
+// as with multiple class shorthands.
+type Attributes []Attribute
+
+// All returns an iterator over the distinct keys of as in the order
+// in which they first occur, along with all of their values.
+func (as Attributes) All() iter.Seq2[string, []string] {
+	return func(yield func(string, []string) bool) {
+		var (
+			keys []string
+			vals = make(map[string][]string, len(as))
+		)
+		for _, a := range as {
+			if _, ok := vals[a.Key]; !ok {
+				keys = append(keys, a.Key)
+			}
+			vals[a.Key] = append(vals[a.Key], a.Value)
+		}
+		for _, k := range keys {
+			if !yield(k, vals[k]) {
+				return
+			}
+		}
+	}
+}
+
+// Values returns the values of all attributes with the given key.
+func (as Attributes) Values(key string) []string {
+	var vs []string
+	for _, a := range as {
+		if a.Key == key {
+			vs = append(vs, a.Value)
+		}
+	}
+	return vs
+}
+
+// Get returns the values of the attributes with the given key joined
+// by spaces, and reports whether any such attribute exists.
+func (as Attributes) Get(key string) (string, bool) {
+	vs := as.Values(key)
+	return strings.Join(vs, " "), vs != nil
+}
+
+// Has reports whether an attribute with the given key exists.
+func (as Attributes) Has(key string) bool {
+	return slices.ContainsFunc(as, func(a Attribute) bool {
+		return a.Key == key
+	})
+}
+
+// Add appends an attribute with the given key and value.
+func (as *Attributes) Add(key, value string) {
+	*as = append(*as, Attribute{Key: key, Value: value})
+}
+
+// Set replaces the values of the attributes with the given key.  The
+// new values take the position of the first such attribute, or are
+// appended if there was none.  Attributes whose values are unchanged
+// keep their spans and trivia.
+func (as *Attributes) Set(key string, values ...string) {
+	i := slices.IndexFunc(*as, func(a Attribute) bool {
+		return a.Key == key
+	})
+	if i == -1 {
+		for _, v := range values {
+			as.Add(key, v)
+		}
+		return
+	}
+
+	old := slices.DeleteFunc(slices.Clone((*as)[i:]), func(a Attribute) bool {
+		return a.Key != key
+	})
+	rest := slices.DeleteFunc((*as)[i:], func(a Attribute) bool {
+		return a.Key == key
+	})
+
+	repl := make([]Attribute, len(values))
+	for j, v := range values {
+		repl[j] = Attribute{Key: key, Value: v}
+		if j < len(old) && old[j].Value == v {
+			repl[j] = old[j]
+		}
+	}
+	*as = slices.Concat((*as)[:i], repl, rest)
+}
+
+// Delete removes all attributes with the given key.
+func (as *Attributes) Delete(key string) {
+	*as = slices.DeleteFunc(*as, func(a Attribute) bool {
+		return a.Key == key
+	})
+}
@@ -0,0 +1,142 @@
+package ast
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestAttributes_All(t *testing.T) {
+	as := Attributes{
+		{Key: "id", Value: "x"},
+		{Key: "class", Value: "a"},
+		{Key: "href", Value: "/"},
+		{Key: "class", Value: "b"},
+	}
+
+	var keys []string
+	var values [][]string
+	for k, vs := range as.All() {
+		keys = append(keys, k)
+		values = append(values, vs)
+	}
+
+	if want := []string{"id", "class", "href"}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	want := [][]string{{"x"}, {"a", "b"}, {"/"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+}
+
+func BenchmarkAttributes_All(b *testing.B) {
+	as := make(Attributes, 20000)
+	for i := range as {
+		as[i] = Attribute{Key: "data-" + strconv.Itoa(i%10000)}
+	}
+	for b.Loop() {
+		for range as.All() {
+		}
+	}
+}
+
+func TestAttributes_Get(t *testing.T) {
+	as := Attributes{
+		{Key: "class", Value: "a"},
+		{Key: "disabled"},
+		{Key: "class", Value: "b"},
+	}
+
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{"class", "a b", true},
+		{"disabled", "", true},
+		{"id", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := as.Get(tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v",
+				tt.key, got, ok, tt.want, tt.ok)
+		}
+		if as.Has(tt.key) != tt.ok {
+			t.Errorf("Has(%q) = %v, want %v", tt.key, !tt.ok, tt.ok)
+		}
+	}
+}
+
+func TestAttributes_Set(t *testing.T) {
+	trivia := &AttributeTrivia{Form: ClassShorthand, Value: "a"}
+	base := Attributes{
+		{Key: "id", Value: "x"},
+		{Key: "class", Value: "a", Trivia: trivia},
+		{Key: "href", Value: "/"},
+		{Key: "class", Value: "b"},
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		values []string
+		want   Attributes
+	}{
+		{
+			name:   "Replace values",
+			key:    "class",
+			values: []string{"a", "c", "d"},
+			want: Attributes{
+				{Key: "id", Value: "x"},
+				{Key: "class", Value: "a", Trivia: trivia},
+				{Key: "class", Value: "c"},
+				{Key: "class", Value: "d"},
+				{Key: "href", Value: "/"},
+			},
+		},
+		{
+			name:   "Append new key",
+			key:    "lang",
+			values: []string{"en"},
+			want: slices.Concat(base, Attributes{
+				{Key: "lang", Value: "en"},
+			}),
+		},
+		{
+			name: "Remove values",
+			key:  "class",
+			want: Attributes{
+				{Key: "id", Value: "x"},
+				{Key: "href", Value: "/"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := slices.Clone(base)
+			as.Set(tt.key, tt.values...)
+			if !reflect.DeepEqual(as, tt.want) {
+				t.Errorf("Set() = %v, want %v", as, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributes_Delete(t *testing.T) {
+	as := Attributes{
+		{Key: "class", Value: "a"},
+		{Key: "id", Value: "x"},
+		{Key: "class", Value: "b"},
+	}
+	as.Delete("class")
+
+	want := Attributes{{Key: "id", Value: "x"}}
+	if !reflect.DeepEqual(as, want) {
+		t.Errorf("Delete() = %v, want %v", as, want)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+const (
+	colourBold  = "\x1b[1m"
+	colourRed   = "\x1b[1;31m"
+	colourCyan  = "\x1b[36m"
+	colourBlue  = "\x1b[34m"
+	colourReset = "\x1b[0m"
+)
+
+var colour = useColour()
+
+// The format in which diagnostics are reported, either ‘text’ or ‘json’
+var diagFormat = "text"
+
+/* Sources of files that have been diagnosed, read only on demand */
+var sources = make(map[string][]byte)
+
+// useColour reports whether diagnostics should be coloured, which is
+// the case when the standard error is a terminal and the user has not
+// asked for colour to be disabled.
+func useColour() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func paint(c, s string) string {
+	if !colour {
+		return s
+	}
+	return c + s + colourReset
+}
+
+// diagnose reports err, which occured while processing the file at
+// path, in the diagnostics format selected by the user.
+func diagnose(path string, err error) {
+	if diagFormat == "json" {
+		diagnoseJSON(path, err)
+	} else {
+		diagnoseText(err)
+	}
+}
+
+// diagnoseText reports err like warn, followed by excerpts of the
+// source code to which err pertains if err is a parser.Error.
+func diagnoseText(err error) {
+	argv0 := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s: %s\n", argv0, paint(colourBold, err.Error()))
+	rv = 1
+
+	var pe parser.Error
+	if !errors.As(err, &pe) {
+		return
+	}
+
+	excerpts := []excerpt{{loc: pe.Position()}}
+	var eofErr parser.EOFError
+	if errors.As(err, &eofErr) && eofErr.Construct != "" {
+		excerpts = append(excerpts,
+			excerpt{loc: eofErr.Open, label: "opened here"})
+	}
+
+	for _, e := range excerpts {
+		e.write()
+	}
+}
+
+// excerpt is a line of source code with the location loc marked.
+type excerpt struct {
+	loc   parser.Location
+	label string
+}
+
+func (e excerpt) write() {
+	line, ok := sourceLine(e.loc.Path, e.loc.Row)
+	if !ok {
+		return
+	}
+
+	col, width := e.loc.Col, 1
+	if span := e.loc.Span; span.Start.IsValid() {
+		col = span.Start.Column
+		width = max(spanWidth(span), 1)
+	}
+
+	/* Pad the marker with the whitespace preceding it such that tabs
+	   line up with the source line */
+	var pad strings.Builder
+	for i, r := range []rune(line) {
+		if i >= col-1 {
+			break
+		}
+		if r == '\t' {
+			pad.WriteByte('\t')
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+
+	var label string
+	if e.label != "" {
+		label = " " + paint(colourCyan, e.label)
+	}
+	marker := "^" + strings.Repeat("~", width-1)
+	gutter := fmt.Sprintf("%5d", e.loc.Row)
+	blank := strings.Repeat(" ", len(gutter))
+
+	fmt.Fprintf(os.Stderr, "%s %s %s\n",
+		paint(colourBlue, gutter), paint(colourBlue, "|"), line)
+	fmt.Fprintf(os.Stderr, "%s %s %s%s%s\n",
+		blank, paint(colourBlue, "|"), pad.String(),
+		paint(colourRed, marker), label)
+}
+
+// spanWidth returns the number of characters spanned by span on its
+// first line.
+func spanWidth(span ast.Span) int {
+	if span.End.Line != span.Start.Line {
+		return 1
+	}
+	return span.End.Column - span.Start.Column
+}
+
+// sourceLine returns the line with the given 1-based line number from
+// the file at path.
+func sourceLine(path string, row int) (string, bool) {
+	if path == "-" || path == "" || row < 1 {
+		return "", false
+	}
+
+	src, ok := sources[path]
+	if !ok {
+		var err error
+		if src, err = os.ReadFile(path); err != nil {
+			src = nil
+		}
+		sources[path] = src
+	}
+
+	line, start := 1, 0
+	for i := 0; i < len(src); {
+		r, n := utf8.DecodeRune(src[i:])
+		switch r {
+		case '\r', '\n', '\v', '\f', '\u0085', '\u2028', '\u2029':
+			if line == row {
+				return string(src[start:i]), true
+			}
+			if r == '\r' && i+1 < len(src) && src[i+1] == '\n' {
+				n++
+			}
+			line++
+			start = i + n
+		}
+		i += n
+	}
+	if line == row && src != nil {
+		return string(src[start:]), true
+	}
+	return "", false
+}
+
+// location is the location of a diagnostic in the JSON diagnostics
+// format.  Lines and columns start at 1, and the end position is
+// exclusive.
+type location struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+}
+
+// record is a single diagnostic in the JSON diagnostics format.
+type record struct {
+	location
+	Severity string            `json:"severity"`
+	Class    string            `json:"class"`
+	Message  string            `json:"message"`
+	Related  []relatedLocation `json:"related,omitempty"`
+}
+
+type relatedLocation struct {
+	location
+	Message string `json:"message"`
+}
+
+func jsonLocation(path string, loc parser.Location) location {
+	l := location{File: cmp.Or(loc.Path, path)}
+	if span := loc.Span; span.Start.IsValid() {
+		l.Line, l.Column = span.Start.Line, span.Start.Column
+		l.EndLine, l.EndColumn = span.End.Line, span.End.Column
+	} else if loc.Row > 0 {
+		l.Line, l.Column = loc.Row, loc.Col
+	}
+	return l
+}
+
+// diagnoseJSON reports err as a single line of JSON.  Errors other than
+// those implementing parser.Error are of the class ‘other’ and have no
+// position within the file.
+func diagnoseJSON(path string, err error) {
+	rv = 1
+	r := record{
+		location: location{File: path},
+		Severity: parser.SeverityError.String(),
+		Class:    "other",
+		Message:  err.Error(),
+	}
+
+	var pe parser.Error
+	if errors.As(err, &pe) {
+		r.location = jsonLocation(path, pe.Position())
+		r.Severity = pe.Severity().String()
+		r.Class = pe.Code()
+		r.Message = pe.Message()
+	}
+
+	var eofErr parser.EOFError
+	if errors.As(err, &eofErr) && eofErr.Construct != "" {
+		r.Related = []relatedLocation{{
+			location: jsonLocation(path, eofErr.Open),
+			Message:  eofErr.Construct + " opened here",
+		}}
+	}
+
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		die("%s", err)
+	}
+}
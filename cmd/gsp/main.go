@@ -1,57 +1,313 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"git.sr.ht/~mango/opts/v2"
+	"git.thomasvoss.com/gsp/v4/ast"
 	"git.thomasvoss.com/gsp/v4/formatter"
 	"git.thomasvoss.com/gsp/v4/parser"
 )
 
 var rv int
 
+// Whether files are transpiled while they are being read, rather than
+// once they have been parsed in full
+var stream bool
+
+// The combined source map of all files, the position in the standard
+// output at which the output of the next file begins, and the output
+// and sources that are mapped, from which columns are computed
+var (
+	sourceMap  *formatter.SourceMap
+	outPos     = ast.Position{Line: 1, Column: 1}
+	mapOutput  bytes.Buffer
+	mapSources = make(map[string][]byte)
+)
+
+var lexers = map[string]parser.BodyLexer{
+	"braces": parser.LexBraces,
+	"css":    parser.LexCSS,
+	"js":     parser.LexJS,
+}
+
+var kinds = map[string]ast.NodeType{
+	"escapable": ast.Escapable,
+	"normal":    ast.Normal,
+	"raw":       ast.Raw,
+	"void":      ast.Void,
+}
+
 func main() {
-	flags, rest, err := opts.Get(os.Args, "cdhI:")
+	flags, rest, err := opts.Get(os.Args, "cC:dD:e:E:hi:I:j:L:mMPp:sS:t:V:xX")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
-		fmt.Fprintf(os.Stderr,
-			"Usage: %s [-cd] [-I dirname] [file ...]\n"+
-				"       %s -h\n",
-			os.Args[0], os.Args[0])
-		os.Exit(1)
+		usage(err)
 	}
 
-	fopts := formatter.Options{Doctype: true}
+	fopts := formatter.Options{Doctype: true, StopOnRecoveredError: true}
+	popts := parser.Options{
+		Recover:    true,
+		Elements:   make(map[string]parser.Element),
+		MediaTypes: make(map[string]parser.BodyLexer),
+	}
 
+	var (
+		mapPath string
+		purge   bool
+	)
 	for _, f := range flags {
 		switch f.Key {
 		case 'c':
 			fopts.Comments = true
+		case 'C':
+			fopts.Cache = formatter.NewMacroCache(f.Value)
 		case 'd':
 			fopts.Doctype = false
+		case 'D':
+			if f.Value != "text" && f.Value != "json" {
+				usage(fmt.Errorf("invalid diagnostics format ‘%s’", f.Value))
+			}
+			diagFormat = f.Value
+		case 'e':
+			name, e, err := parseElement(f.Value)
+			if err != nil {
+				usage(err)
+			}
+			popts.Elements[name] = e
+		case 'E':
+			if f.Value == "" || strings.Contains(f.Value, "=") {
+				usage(fmt.Errorf("invalid variable name ‘%s’", f.Value))
+			}
+			fopts.EnvPolicy = formatter.EnvAllowlist
+			fopts.EnvAllow = append(fopts.EnvAllow, f.Value)
 		case 'h':
 			openManual()
 			os.Exit(0)
+		case 'i':
+			if fopts.Indent, err = parseIndent(f.Value); err != nil {
+				usage(err)
+			}
 		case 'I':
 			fopts.SearchPath = append(fopts.SearchPath, f.Value)
+		case 'L':
+			if err := parseLimit(f.Value, &fopts); err != nil {
+				usage(err)
+			}
+		case 'j':
+			n, err := strconv.Atoi(f.Value)
+			if err != nil || n < 1 {
+				usage(fmt.Errorf("invalid job count ‘%s’", f.Value))
+			}
+			fopts.MacroWorkers = n
+		case 'm':
+			fopts.Minify = true
+		case 'M':
+			fopts.Minify = true
+			fopts.MinifyRaw = true
+		case 'p':
+			fopts.Prolog = f.Value
+		case 'P':
+			purge = true
+		case 's':
+			stream = true
+		case 'S':
+			mapPath = f.Value
+			sourceMap = &formatter.SourceMap{}
+		case 't':
+			/* Split at the last ‘=’, as media type parameters contain
+			   them too */
+			i := strings.LastIndexByte(f.Value, '=')
+			lex, ok := lexers[f.Value[i+1:]]
+			if i == -1 || !ok {
+				usage(fmt.Errorf("invalid lexer ‘%s’", f.Value[i+1:]))
+			}
+			popts.MediaTypes[parser.MediaType(f.Value[:i])] = lex
+		case 'V':
+			if k, _, ok := strings.Cut(f.Value, "="); !ok || k == "" {
+				usage(fmt.Errorf("invalid variable definition ‘%s’", f.Value))
+			}
+			fopts.Env = append(fopts.Env, f.Value)
+		case 'x':
+			fopts.XML = true
+		case 'X':
+			fopts.EnvPolicy = formatter.EnvAllowlist
+		}
+	}
+
+	if purge {
+		if fopts.Cache == nil {
+			usage(errors.New("-P requires a cache directory to be given with -C"))
+		}
+		if err := fopts.Cache.Purge(); err != nil {
+			die("%s", err)
+		}
+		if len(rest) == 0 {
+			os.Exit(0)
 		}
 	}
 
+	/* Stop processing and kill running macros when interrupted */
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+
+	/* Macro servers are reused across files */
+	fopts.Servers = formatter.NewMacroServers()
+
 	if len(rest) == 0 {
-		process("-", fopts)
+		process(ctx, "-", popts, fopts)
 	}
 
 	for _, a := range rest {
-		process(a, fopts)
+		if ctx.Err() != nil {
+			break
+		}
+		process(ctx, a, popts, fopts)
+	}
+	stop()
+	if err := fopts.Servers.Close(); err != nil {
+		warn("%s", err)
+	}
+
+	if sourceMap != nil {
+		if err := writeSourceMap(mapPath); err != nil {
+			warn("%s", err)
+		}
 	}
 
 	os.Exit(rv)
 }
 
-func process(path string, fopts formatter.Options) {
+func usage(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+	fmt.Fprintf(os.Stderr,
+		"Usage: %s [-cdmMPsxX] [-C dirname] [-D format] [-e element=kind] [-E name] [-i indent] [-I dirname] [-j jobs] [-L limit=value] [-p prolog] [-S file] [-t type=lexer] [-V name=value] [file ...]\n"+
+			"       %s -C dirname -P\n"+
+			"       %s -h\n",
+		os.Args[0], os.Args[0], os.Args[0])
+	os.Exit(1)
+}
+
+// parseElement parses an element definition of the form
+// ‘element=kind[:lexer]’.
+func parseElement(s string) (string, parser.Element, error) {
+	name, kind, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", parser.Element{},
+			fmt.Errorf("invalid element definition ‘%s’", s)
+	}
+
+	kind, lexer, hasLexer := strings.Cut(kind, ":")
+	ty, ok := kinds[kind]
+	if !ok {
+		return "", parser.Element{}, fmt.Errorf("invalid element kind ‘%s’", kind)
+	}
+
+	e := parser.Element{Type: ty}
+	if hasLexer {
+		if ty != ast.Raw {
+			return "", parser.Element{},
+				fmt.Errorf("lexer given for non-raw element ‘%s’", name)
+		}
+		if e.Lexer, ok = lexers[lexer]; !ok {
+			return "", parser.Element{}, fmt.Errorf("invalid lexer ‘%s’", lexer)
+		}
+	}
+	return name, e, nil
+}
+
+// parseIndent parses an indentation given either as a number of spaces
+// or as ‘tab’.
+func parseIndent(s string) (string, error) {
+	if s == "tab" {
+		return "\t", nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("invalid indentation ‘%s’", s)
+	}
+	return strings.Repeat(" ", n), nil
+}
+
+// parseLimit parses a macro limit of the form ‘limit=value’ into opts.
+func parseLimit(s string, opts *formatter.Options) error {
+	name, v, _ := strings.Cut(s, "=")
+	var err error
+	switch name {
+	case "time":
+		opts.MacroTimeout, err = parseDuration(v)
+	case "cpu":
+		opts.MacroCPULimit, err = parseDuration(v)
+	case "output":
+		opts.MaxMacroOutput, err = parseSize(v)
+	case "memory":
+		opts.MacroMemoryLimit, err = parseSize(v)
+	case "depth":
+		opts.MaxMacroDepth, err = strconv.Atoi(v)
+		if err == nil && opts.MaxMacroDepth <= 0 {
+			err = errors.New("depth must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid limit ‘%s’", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for limit ‘%s’: ‘%s’", name, v)
+	}
+	return nil
+}
+
+// parseDuration parses a positive duration, given either as a number of
+// seconds or with a unit as accepted by time.ParseDuration.
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil && n > 0 {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("non-positive duration")
+	}
+	return d, err
+}
+
+// parseSize parses a positive number of bytes, optionally suffixed with
+// ‘K’, ‘M’, or ‘G’ for kibibytes, mebibytes, or gibibytes.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	if n := len(s); n != 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		}
+		if shift != 0 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && (n <= 0 || n > math.MaxInt64>>shift) {
+		err = errors.New("size out of range")
+	}
+	return n << shift, err
+}
+
+func process(ctx context.Context, path string, popts parser.Options,
+	fopts formatter.Options) {
 	var (
 		file *os.File
 		err  error
@@ -61,26 +317,119 @@ func process(path string, fopts formatter.Options) {
 		file = os.Stdin
 	} else {
 		if file, err = os.Open(path); err != nil {
-			warn("%s", err)
+			diagnose(path, err)
 			return
 		} else {
 			defer file.Close()
 		}
 	}
 
-	ast, err := parser.Parse(file, path)
+	var (
+		sm  formatter.SourceMap
+		src bytes.Buffer
+		r   io.Reader = file
+	)
+	out := countingWriter{w: bufio.NewWriter(os.Stdout)}
+	if sourceMap != nil {
+		fopts.SourceMap = &sm
+		r = io.TeeReader(file, &src)
+		out.copy = &mapOutput
+	}
+
+	var errs parser.ErrorList
+	if stream {
+		dec := parser.NewDecoderContext(ctx, r, path, popts)
+		err = formatter.WriteStreamContext(ctx, &out, path, dec, fopts)
+
+		/* Formatting stops at the first syntax error, but the remainder
+		   of the document is still read to report all of its errors */
+		if errors.As(err, &errs) {
+			for err = nil; err == nil; {
+				_, err = dec.Next()
+			}
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		errors.As(dec.Err(), &errs)
+	} else {
+		/* Nothing is written and no macros are run for documents with
+		   syntax errors */
+		var nodes []ast.Node
+		nodes, err = parser.ParseContext(ctx, r, path, popts)
+		if errors.As(err, &errs) {
+			err = nil
+		} else if err == nil {
+			err = formatter.WriteAstContext(ctx, &out, path, nodes, fopts)
+		}
+	}
+	for _, err := range errs {
+		diagnose(path, err)
+	}
 	if err != nil {
-		warn("%s", err)
-		return
+		diagnose(path, err)
 	}
 
-	if err = formatter.WriteAst(os.Stdout, path, ast, fopts); err != nil {
-		warn("%s", err)
-		return
+	if out.n != 0 {
+		fmt.Fprint(&out, "\n")
+	}
+	if err = out.w.Flush(); err != nil {
+		diagnose(path, err)
 	}
-	if len(ast) != 0 || fopts.Doctype {
-		fmt.Print("\n")
+
+	/* The output of each file begins on a new line, so only offsets
+	   and line numbers need adjusting */
+	for _, m := range sm.Mappings {
+		for _, p := range []*ast.Position{&m.Output.Start, &m.Output.End} {
+			p.Offset += outPos.Offset
+			p.Line += outPos.Line - 1
+		}
+		sourceMap.Mappings = append(sourceMap.Mappings, m)
+	}
+	if sourceMap != nil {
+		mapSources[path] = src.Bytes()
+	}
+	outPos.Offset += out.n
+	outPos.Line += out.lines
+}
+
+// writeSourceMap writes the combined source map to the file path.
+func writeSourceMap(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := sourceMap.WriteJSON(f, "", mapOutput.Bytes(), mapSources); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// countingWriter counts the bytes and lines written through it.  As in
+// the formatter, line feeds, carriage returns, and carriage return–line
+// feed pairs each end a line.
+type countingWriter struct {
+	w     *bufio.Writer
+	copy  *bytes.Buffer /* If non-nil, receives a copy of what is written */
+	n     int
+	lines int
+	cr    bool /* The last byte written was a carriage return */
+}
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	n, err := w.w.Write(bs)
+	if w.copy != nil {
+		w.copy.Write(bs[:n])
+	}
+	w.n += n
+	for _, b := range bs[:n] {
+		if b == '\r' || b == '\n' && !w.cr {
+			w.lines++
+		}
+		w.cr = b == '\r'
 	}
+	return n, err
 }
 
 func openManual() {
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+var rv int
+
+// location is the location of a diagnostic as reported by gsp(1).
+type location struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine"`
+	EndColumn int    `json:"endColumn"`
+}
+
+// record is a single diagnostic as reported by gsp(1).
+type record struct {
+	location
+	Severity string `json:"severity"`
+	Class    string `json:"class"`
+	Message  string `json:"message"`
+	Related  []struct {
+		location
+		Message string `json:"message"`
+	} `json:"related"`
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name  string      `json:"name"`
+		Rules []sarifRule `json:"rules"`
+	} `json:"driver"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations,omitempty"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	ID               *int          `json:"id,omitempty"`
+	PhysicalLocation sarifPhysical `json:"physicalLocation"`
+	Message          *sarifMessage `json:"message,omitempty"`
+}
+
+type sarifPhysical struct {
+	ArtifactLocation struct {
+		URI string `json:"uri"`
+	} `json:"artifactLocation"`
+	Region *sarifRegion `json:"region,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+func main() {
+	flags, rest, err := opts.Get(os.Args, "h")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s [file ...]\n"+
+				"       %s -h\n",
+			os.Args[0], os.Args[0])
+		os.Exit(1)
+	}
+
+	for _, f := range flags {
+		switch f.Key {
+		case 'h':
+			openManual()
+			os.Exit(0)
+		}
+	}
+
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "gsp"
+	run.Tool.Driver.Rules = []sarifRule{}
+
+	if len(rest) == 0 {
+		process("-", &run)
+	}
+
+	for _, a := range rest {
+		process(a, &run)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+	if err != nil {
+		die("%s", err)
+	}
+
+	os.Exit(rv)
+}
+
+func process(filename string, run *sarifRun) {
+	var (
+		file *os.File
+		err  error
+	)
+
+	if filename == "-" {
+		file = os.Stdin
+	} else {
+		if file, err = os.Open(filename); err != nil {
+			warn("%s", err)
+			return
+		} else {
+			defer file.Close()
+		}
+	}
+
+	sc := bufio.NewScanner(file)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			warn("%s:%d: %s", filename, n, err)
+			continue
+		}
+		run.Results = append(run.Results, convert(r))
+		if !slices.Contains(run.Tool.Driver.Rules, sarifRule{r.Class}) {
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules,
+				sarifRule{r.Class})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		warn("%s: %s", filename, err)
+	}
+}
+
+// convert converts a diagnostic reported by gsp(1) into a SARIF result.
+func convert(r record) sarifResult {
+	res := sarifResult{
+		RuleID:  r.Class,
+		Level:   r.Severity,
+		Message: sarifMessage{r.Message},
+	}
+	if res.Level != "error" && res.Level != "warning" {
+		res.Level = "note"
+	}
+
+	if r.File != "" {
+		res.Locations = []sarifLocation{{PhysicalLocation: physical(r.location)}}
+	}
+	for i, rel := range r.Related {
+		id := i
+		res.RelatedLocations = append(res.RelatedLocations, sarifLocation{
+			ID:               &id,
+			PhysicalLocation: physical(rel.location),
+			Message:          &sarifMessage{rel.Message},
+		})
+	}
+	return res
+}
+
+func physical(l location) sarifPhysical {
+	var p sarifPhysical
+	p.ArtifactLocation.URI = filepath.ToSlash(l.File)
+	if l.Line > 0 {
+		p.Region = &sarifRegion{
+			StartLine:   l.Line,
+			StartColumn: l.Column,
+			EndLine:     l.EndLine,
+			EndColumn:   l.EndColumn,
+		}
+	}
+	return p
+}
+
+func openManual() {
+	cmd := exec.Command("man", "1", "gspsarif")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		die("%s", err)
+	}
+}
+
+func warn(format string, args ...any) {
+	argv0 := filepath.Base(os.Args[0])
+	args = append([]any{argv0}, args...)
+	fmt.Fprintf(os.Stderr, "%s: "+format+"\n", args...)
+	rv = 1
+}
+
+func die(format string, args ...any) {
+	warn(format, args...)
+	os.Exit(1)
+}
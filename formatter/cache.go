@@ -0,0 +1,194 @@
+package formatter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// NoCacheMarker is the string by which a macro opts out of caching.  A
+// macro whose executable contains NoCacheMarker anywhere, such as in a
+// comment of a script, is always run.
+const NoCacheMarker = "gsp:nocache"
+
+// MacroCache is an on-disk cache of the output of macros.  Macros are
+// assumed to be pure functions of their executable, attributes, the
+// value of GSP_TEXT_P, and body, which together form the key of each
+// entry.  Macros which depend on anything else, such as the time, the
+// environment, or GSP_PATH, should opt out with NoCacheMarker.
+//
+// Only the standard output of macros that exit successfully is cached.
+// The standard error of a macro is not replayed when its output is
+// read from the cache.
+//
+// A MacroCache may be used by multiple goroutines, and multiple
+// processes may share the same directory.
+type MacroCache struct {
+	dir string
+}
+
+// NewMacroCache returns a cache storing its entries in the directory
+// dir, which is created when needed.
+func NewMacroCache(dir string) *MacroCache {
+	return &MacroCache{dir: dir}
+}
+
+// Dir returns the directory in which the cache stores its entries.
+func (c *MacroCache) Dir() string {
+	return c.dir
+}
+
+// Purge removes all entries from the cache.  Files in the cache
+// directory that were not created by the cache are left untouched.
+func (c *MacroCache) Purge() error {
+	subdirs, err := os.ReadDir(c.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, sd := range subdirs {
+		if !sd.IsDir() || !isHex(sd.Name(), 2) {
+			continue
+		}
+		dir := filepath.Join(c.dir, sd.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if isHex(name, sha256.Size*2-2) || isTempName(name) {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+		/* Fails if anything else was in the directory */
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// key returns the key of the entry for the macro node run from the
+// executable exe, or the empty string if the macro opted out of
+// caching.
+func (c *MacroCache) key(exe macroExecutable, node ast.Node) (string, error) {
+	if exe.nocache {
+		return "", nil
+	}
+
+	h := sha256.New()
+	field := func(s string) {
+		fmt.Fprintf(h, "%d:%s,", len(s), s)
+	}
+	field("gsp macro cache 2")
+	field(exe.sum)
+	for k, vs := range node.Attributes.All() {
+		field(k)
+		fmt.Fprintf(h, "%d,", len(vs))
+		for _, v := range vs {
+			field(v)
+		}
+	}
+	field(textP(node))
+
+	/* The protocol determines how the output is interpreted */
+	if exe.json {
+		field("json")
+	} else {
+		field("gsp")
+	}
+
+	var body bytes.Buffer
+	if err := WriteUntranslatedAST(&body, node.Children); err != nil {
+		return "", err
+	}
+	field(body.String())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// path returns the path of the entry with the given key.
+func (c *MacroCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key[2:])
+}
+
+// open opens the entry with the given key.
+func (c *MacroCache) open(key string) (*os.File, error) {
+	return os.Open(c.path(key))
+}
+
+// create returns a writer for the entry with the given key.  The entry
+// only becomes visible once committed.
+func (c *MacroCache) create(key string) (*cacheWriter, error) {
+	dir := filepath.Dir(c.path(key))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{f: f, path: c.path(key)}, nil
+}
+
+const tempPrefix = ".tmp-"
+
+// cacheWriter writes a cache entry to a temporary file, which is
+// renamed into place once the entry is complete such that readers never
+// see partial entries.
+type cacheWriter struct {
+	f    *os.File
+	path string
+}
+
+func (w *cacheWriter) Write(bs []byte) (int, error) {
+	return w.f.Write(bs)
+}
+
+func (w *cacheWriter) commit() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+func (w *cacheWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// textP returns the value of GSP_TEXT_P for the macro node.
+func textP(node ast.Node) string {
+	if len(node.Children) != 0 && node.Children[0].Type == ast.Text {
+		return "1"
+	}
+	return "0"
+}
+
+// isHex reports whether s consists of n lowercase hexadecimal digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isTempName(s string) bool {
+	return strings.HasPrefix(s, tempPrefix)
+}
@@ -0,0 +1,120 @@
+package formatter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+func TestMacroCache(t *testing.T) {
+	macros := t.TempDir()
+	script, err := os.ReadFile("testdata/macros/count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nocache := strings.Replace(string(script), "\n", "\n# "+NoCacheMarker+"\n", 1)
+	for name, s := range map[string]string{"count": string(script), "now": nocache} {
+		err := os.WriteFile(filepath.Join(macros, name), []byte(s), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	log := filepath.Join(t.TempDir(), "log")
+	cache := NewMacroCache(dir)
+
+	/* Each step runs the input and checks the total number of macro
+	   runs so far */
+	steps := []struct {
+		name  string
+		input string
+		want  string
+		runs  int
+		purge bool
+	}{
+		{"First run", `$count { p {-a} }`, "<p>a</p>", 1, false},
+		{"Cached", `$count { p {-a} }`, "<p>a</p>", 1, false},
+		{"Cached verbatim", `$$count { p {-a} }`, "p {=a}", 1, false},
+		{"Different body", `$count { p {-b} }`, "<p>b</p>", 2, false},
+		{"Different attributes", `$count x="y" { p {-a} }`, "<p>a</p>", 3, false},
+		{"Text body", `$$count {-p}`, "p", 4, false},
+		{"Opted out", `$now { p {-a} }`, "<p>a</p>", 5, false},
+		{"Opted out again", `$now { p {-a} }`, "<p>a</p>", 6, false},
+		{"Purged", `$count { p {-a} }`, "<p>a</p>", 7, true},
+	}
+
+	/* Files not created by the cache survive purging */
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range steps {
+		if st.purge {
+			if err := cache.Purge(); err != nil {
+				t.Fatalf("%s: Purge() error = %v", st.name, err)
+			}
+		}
+
+		input := strings.Replace(st.input, " ", ` log="`+log+`" `, 1)
+		nodes, err := parser.Parse(strings.NewReader(input), "<string>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = WriteAst(&out, "<string>", nodes, Options{
+			SearchPath: []string{macros},
+			Cache:      cache,
+		})
+		if err != nil {
+			t.Fatalf("%s: WriteAst() error = %v", st.name, err)
+		}
+		if got := out.String(); got != st.want {
+			t.Errorf("%s: output = %q, want %q", st.name, got, st.want)
+		}
+
+		bs, _ := os.ReadFile(log)
+		if got := bytes.Count(bs, []byte("\n")); got != st.runs {
+			t.Errorf("%s: macros run %d times, want %d", st.name, got,
+				st.runs)
+		}
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Purge() removed unrelated file: %v", err)
+	}
+}
+
+func TestMacroCacheFailure(t *testing.T) {
+	cache := NewMacroCache(t.TempDir())
+	for range 2 {
+		nodes, err := parser.Parse(strings.NewReader("$fail {}"), "<string>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteAst(&bytes.Buffer{}, "<string>", nodes, Options{
+			SearchPath: []string{"testdata/macros"},
+			Stderr:     &bytes.Buffer{},
+			Cache:      cache,
+		})
+		if err == nil {
+			t.Fatalf("WriteAst() error = nil, want failure")
+		}
+	}
+
+	entries, err := os.ReadDir(cache.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		files, _ := os.ReadDir(filepath.Join(cache.Dir(), e.Name()))
+		if len(files) != 0 {
+			t.Errorf("cache contains %d files after failures", len(files))
+		}
+	}
+}
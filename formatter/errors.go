@@ -0,0 +1,243 @@
+package formatter
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+// ErrMacroNotFound indicates that no executable for a macro was found
+// in the macro search path.
+var ErrMacroNotFound = errors.New("failed to find macro")
+
+// ErrLimitsUnsupported indicates that resource limits for macros were
+// requested on a system which does not support them.
+var ErrLimitsUnsupported = errors.New(
+	"resource limits for macros are only supported on Linux")
+
+// MacroError indicates that a macro could not be expanded.  It
+// implements parser.Error, with its location being the name of the
+// macro node.
+//
+// If a macro invoked within the output of another macro could not be
+// expanded, the MacroError of the outer macro wraps that of the inner
+// one, such that the outermost MacroError is located in the document.
+// Backtrace returns the chain of expansions.
+type MacroError struct {
+	// Where is the location of the invocation.  Invocations within the
+	// output of another macro are located within that output, the path
+	// of which names the macro, as in ‘<output of $foo>’.  The output of
+	// macros using the JSON protocol has no positions.
+	Where parser.Location
+	Name  string
+	// Executable is the path of the executable of the macro, if found.
+	Executable string
+	// ExitCode is the exit status of the macro if it exited
+	// unsuccessfully, or -1 otherwise.
+	ExitCode int
+	// Stderr holds the end of the standard error of the macro, which
+	// was copied to Options.Stderr as usual.
+	Stderr string
+	Err    error
+
+	call string /* The name of the macro as invoked, such as ‘$$foo’ */
+}
+
+// The number of bytes at the end of the standard error of a failing
+// macro held in MacroError.Stderr
+const maxStderrTail = 4096
+
+func newMacroError(path string, node ast.Node, err error) MacroError {
+	loc := parser.Location{Path: path}
+	if start := node.Span.Start; start.IsValid() {
+		name := invocation(node)
+		end := start
+		end.Offset += len(name)
+		end.Column += utf8.RuneCountInString(name)
+		loc.Row, loc.Col = start.Line, start.Column
+		loc.Span = ast.Span{Start: start, End: end}
+	}
+
+	e := MacroError{
+		Where:    loc,
+		Name:     node.Name,
+		ExitCode: -1,
+		Err:      err,
+		call:     invocation(node),
+	}
+	if f, ok := err.(macroFailure); ok {
+		e.Executable, e.Stderr, e.Err = f.exe, f.stderr, f.err
+	}
+	if xerr, ok := e.Err.(*exec.ExitError); ok && xerr.Exited() {
+		e.ExitCode = xerr.ExitCode()
+	}
+	return e
+}
+
+// macroFailure adds the details of the macro that failed to err.
+type macroFailure struct {
+	exe    string
+	stderr string
+	err    error
+}
+
+func (f macroFailure) Error() string { return f.err.Error() }
+func (f macroFailure) Unwrap() error { return f.err }
+
+// invocation returns the name of the macro node as it is invoked.
+func invocation(node ast.Node) string {
+	if node.Type == ast.VerbatimMacro {
+		return "$$" + node.Name
+	}
+	return "$" + node.Name
+}
+
+// outputPath returns the path by which the output of the macro node is
+// referred to in errors.
+func outputPath(node ast.Node) string {
+	return "<output of " + invocation(node) + ">"
+}
+
+// Backtrace returns the chain of macro expansions that led to e, from
+// the macro that failed to the invocation in the document.
+func (e MacroError) Backtrace() []MacroError {
+	var bt []MacroError
+	for {
+		bt = append(bt, e)
+		var inner MacroError
+		if !errors.As(e.Err, &inner) {
+			break
+		}
+		e = inner
+	}
+	slices.Reverse(bt)
+	return bt
+}
+
+func (e MacroError) Error() string {
+	if e.Where.Row == 0 {
+		return fmt.Sprintf("%s: %s", e.Where.Path, e.Message())
+	}
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+// Message returns the message of the macro that failed.  If the failure
+// occurred within the output of a macro, it is followed by a line for
+// each expansion in the backtrace.
+func (e MacroError) Message() string {
+	bt := e.Backtrace()
+	msg := fmt.Sprintf("macro ‘%s’: %s", bt[0].Name, bt[0].Err)
+
+	var perr parser.Error
+	if len(bt) == 1 && !errors.As(bt[0].Err, &perr) {
+		return msg
+	}
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, f := range bt {
+		where := f.Where.String()
+		if f.Where.Row == 0 {
+			where = f.Where.Path
+		}
+		fmt.Fprintf(&sb, "\n\tin expansion of %s at %s", f.call, where)
+	}
+	return sb.String()
+}
+
+func (e MacroError) Position() parser.Location { return e.Where }
+func (e MacroError) Severity() parser.Severity { return parser.SeverityError }
+func (e MacroError) Unwrap() error             { return e.Err }
+
+func (e MacroError) Code() string {
+	var (
+		terr MacroTimeoutError
+		oerr MacroOutputError
+		cerr MacroCPUTimeError
+		rerr MacroRecursionError
+	)
+	switch {
+	case errors.As(e.Err, &rerr) && rerr.Limit == 0:
+		return "macro-cycle"
+	case errors.As(e.Err, &rerr):
+		return "macro-depth"
+	case errors.As(e.Err, &terr):
+		return "macro-timeout"
+	case errors.As(e.Err, &oerr):
+		return "macro-output"
+	case errors.As(e.Err, &cerr):
+		return "macro-cpu-time"
+	}
+	return "macro"
+}
+
+// MacroTimeoutError indicates that a macro was killed for running for
+// longer than Options.MacroTimeout.
+type MacroTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e MacroTimeoutError) Error() string {
+	return fmt.Sprintf("killed after running for longer than %s", e.Limit)
+}
+
+// MacroOutputError indicates that a macro was killed for writing more
+// than Options.MaxMacroOutput bytes to its standard output.
+type MacroOutputError struct {
+	Limit int64
+}
+
+func (e MacroOutputError) Error() string {
+	return fmt.Sprintf("killed after writing more than %d bytes of output",
+		e.Limit)
+}
+
+// MacroCPUTimeError indicates that a macro was killed for using more
+// than Options.MacroCPULimit of CPU time.
+type MacroCPUTimeError struct {
+	Limit time.Duration
+}
+
+func (e MacroCPUTimeError) Error() string {
+	return fmt.Sprintf("killed after using more than %s of CPU time", e.Limit)
+}
+
+// AttributeCollisionError indicates that two attributes of a macro
+// would set the same environment variable, such as ‘data-x’ and
+// ‘data_x’, which both set GSP_ATTR_DATA_X.
+type AttributeCollisionError struct {
+	Attributes [2]string
+	Variable   string
+}
+
+func (e AttributeCollisionError) Error() string {
+	return fmt.Sprintf("attributes ‘%s’ and ‘%s’ both set %s",
+		e.Attributes[0], e.Attributes[1], e.Variable)
+}
+
+// MacroRecursionError indicates that the expansion of a macro was
+// abandoned, either for exceeding Options.MaxMacroDepth or for
+// invoking itself with the same attributes and body.
+type MacroRecursionError struct {
+	// Chain lists the invocations being expanded, outermost first,
+	// followed by the abandoned invocation.
+	Chain []string
+	// Limit is the maximum depth that was exceeded, or 0 if a cycle
+	// was detected.
+	Limit int
+}
+
+func (e MacroRecursionError) Error() string {
+	chain := strings.Join(e.Chain, " → ")
+	if e.Limit == 0 {
+		return "expansion never ends: " + chain
+	}
+	return fmt.Sprintf("expansion exceeds the maximum depth of %d: %s",
+		e.Limit, chain)
+}
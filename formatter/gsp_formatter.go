@@ -4,8 +4,8 @@ import (
 	"cmp"
 	"fmt"
 	"io"
-	"maps"
 	"strings"
+	"unicode"
 
 	"git.thomasvoss.com/gsp/v4/ast"
 	g_strconv "git.thomasvoss.com/gsp/v4/strconv"
@@ -19,7 +19,9 @@ import (
 // Node that the output markup may not be 1:1 identical to the
 // original input from which the AST was parsed.  The only guarantee
 // is that both the original source and the output of this function
-// are semantically equivalant.
+// are semantically equivalant.  If the AST was parsed with trivia
+// however, every node and attribute left unmodified is written
+// exactly as it appeared in the source.
 func WriteUntranslatedAST(out io.Writer, ast []ast.Node) error {
 	for _, n := range ast {
 		if err := writeUntranslatedNode(out, n); err != nil {
@@ -32,9 +34,19 @@ func WriteUntranslatedAST(out io.Writer, ast []ast.Node) error {
 func writeUntranslatedNode(out io.Writer, node ast.Node) error {
 	var e1, e2, e3 error
 
+	if node.Trivia != nil && node.Type != ast.Text {
+		if _, err := fmt.Fprint(out, node.Trivia.Leading); err != nil {
+			return err
+		}
+	}
+
 	switch node.Type {
 	case ast.Comment:
-		_, e1 = fmt.Fprint(out, "/ ")
+		sep := " "
+		if node.Children[0].Trivia != nil {
+			sep = ""
+		}
+		_, e1 = fmt.Fprint(out, "/"+sep)
 		e2 = writeUntranslatedNode(out, node.Children[0])
 	case ast.Macro:
 		_, e1 = fmt.Fprint(out, "$")
@@ -54,14 +66,24 @@ func writeUntranslatedNode(out io.Writer, node ast.Node) error {
 		e1 = writeUntranslatedText(out, node.Name)
 	}
 
-	return cmp.Or(e1, e2, e3)
+	if err := cmp.Or(e1, e2, e3); err != nil {
+		return err
+	}
+	if node.Trivia != nil {
+		_, err := fmt.Fprint(out, node.Trivia.After)
+		return err
+	}
+	return nil
 }
 
 func writeUntranslatedTag(out io.Writer, node ast.Node) error {
+	if node.Trivia != nil {
+		return writeUntranslatedTagTrivia(out, node)
+	}
 	if _, err := fmt.Fprintf(out, "%s ", node.Name); err != nil {
 		return err
 	}
-	for k, vs := range maps.All(node.Attributes) {
+	for k, vs := range node.Attributes.All() {
 		v := g_strconv.EscapeString(strings.Join(vs, " "))
 		if _, err := fmt.Fprintf(out, `%s="%s" `, k, v); err != nil {
 			return err
@@ -70,9 +92,64 @@ func writeUntranslatedTag(out io.Writer, node ast.Node) error {
 	return nil
 }
 
+// writeUntranslatedTagTrivia is like writeUntranslatedTag but writes
+// every attribute with trivia as it was written in the source.
+// Modified attributes are written in long form.
+func writeUntranslatedTagTrivia(out io.Writer, node ast.Node) error {
+	if _, err := fmt.Fprint(out, node.Name); err != nil {
+		return err
+	}
+
+	for _, a := range node.Attributes {
+		at := a.Trivia
+		if at == nil {
+			at = &ast.AttributeTrivia{Leading: " ", Value: a.Value}
+			at.Raw = g_strconv.EscapeString(a.Value)
+		}
+
+		var s string
+		switch {
+		case a.Value != at.Value:
+			s = fmt.Sprintf(`%s="%s"`, a.Key, g_strconv.EscapeString(a.Value))
+		case at.Form == ast.IDShorthand && a.Key == "id":
+			s = "#" + a.Value
+		case at.Form == ast.ClassShorthand && a.Key == "class":
+			s = "." + a.Value
+		case at.Form == ast.BareAttribute:
+			s = a.Key
+		default:
+			s = fmt.Sprintf(`%s="%s"`, a.Key, at.Raw)
+		}
+		if _, err := fmt.Fprint(out, at.Leading+s); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprint(out, node.Trivia.BeforeBody)
+	return err
+}
+
 func writeUntranslatedBody(out io.Writer, node ast.Node) error {
 	if len(node.Children) != 0 && node.Children[0].Type == ast.Text {
-		if _, err := fmt.Fprint(out, "{="); err != nil {
+		/* Only reproduce a trimmed body if doing so cannot trim away
+		   any of the text */
+		var trimmed bool
+		if node.Trivia != nil && node.Trivia.Body == ast.TrimmedTextBody {
+			first := node.Children[0].Name
+			last := node.Children[len(node.Children)-1]
+			trimmed = strings.TrimLeftFunc(first, unicode.IsSpace) == first &&
+				last.Type == ast.Text &&
+				strings.TrimRightFunc(last.Name, unicode.IsSpace) == last.Name
+		}
+
+		opener := "{="
+		if trimmed {
+			opener = "{-"
+			if t := node.Children[0].Trivia; t != nil {
+				opener += t.Leading
+			}
+		}
+		if _, err := fmt.Fprint(out, opener); err != nil {
 			return err
 		}
 
@@ -87,6 +164,12 @@ func writeUntranslatedBody(out io.Writer, node ast.Node) error {
 				return err
 			}
 		}
+
+		if trimmed {
+			if _, err := fmt.Fprint(out, node.Trivia.Trailing); err != nil {
+				return err
+			}
+		}
 	} else {
 		if _, err := fmt.Fprint(out, "{"); err != nil {
 			return err
@@ -95,6 +178,12 @@ func writeUntranslatedBody(out io.Writer, node ast.Node) error {
 		if err := WriteUntranslatedAST(out, node.Children); err != nil {
 			return err
 		}
+
+		if node.Trivia != nil {
+			if _, err := fmt.Fprint(out, node.Trivia.Trailing); err != nil {
+				return err
+			}
+		}
 	}
 
 	_, err := fmt.Fprint(out, "}")
@@ -102,7 +191,11 @@ func writeUntranslatedBody(out io.Writer, node ast.Node) error {
 }
 
 func writeUntranslatedRawBody(out io.Writer, node ast.Node) error {
-	_, err := fmt.Fprintf(out, "{%s}", node.Children[0].Name)
+	var s string
+	if len(node.Children) != 0 {
+		s = node.Children[0].Name
+	}
+	_, err := fmt.Fprintf(out, "{%s}", s)
 	return err
 }
 
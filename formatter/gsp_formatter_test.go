@@ -1,10 +1,13 @@
 package formatter
 
 import (
+	"io"
+	"os"
 	"strings"
 	"testing"
 
 	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
 )
 
 func TestWriteUntranslatedAST(t *testing.T) {
@@ -30,8 +33,8 @@ func TestWriteUntranslatedAST(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "a",
-					Attributes: map[string][]string{
-						"href": {"https://example.com"},
+					Attributes: ast.Attributes{
+						{Key: "href", Value: "https://example.com"},
 					},
 				},
 			},
@@ -43,8 +46,8 @@ func TestWriteUntranslatedAST(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "span",
-					Attributes: map[string][]string{
-						"data-text": {`some "quoted" \ text`},
+					Attributes: ast.Attributes{
+						{Key: "data-text", Value: `some "quoted" \ text`},
 					},
 				},
 			},
@@ -118,8 +121,8 @@ func TestWriteUntranslatedAST(t *testing.T) {
 				{
 					Type: ast.Macro,
 					Name: "date",
-					Attributes: map[string][]string{
-						"format": {"%Y"},
+					Attributes: ast.Attributes{
+						{Key: "format", Value: "%Y"},
 					},
 					Children: []ast.Node{},
 				},
@@ -132,8 +135,8 @@ func TestWriteUntranslatedAST(t *testing.T) {
 				{
 					Type: ast.VerbatimMacro,
 					Name: "syntax_highlight",
-					Attributes: map[string][]string{
-						"lang": {"c"},
+					Attributes: ast.Attributes{
+						{Key: "lang", Value: "c"},
 					},
 					Children: []ast.Node{},
 				},
@@ -173,3 +176,115 @@ func TestWriteUntranslatedAST(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteUntranslatedASTTrivia(t *testing.T) {
+	example, err := os.ReadFile("../example.gsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		edit  func([]ast.Node)
+		want  string
+	}{
+		{
+			name:  "Example document",
+			input: string(example),
+			want:  string(example),
+		},
+		{
+			name:  "Whitespace and comments",
+			input: "\n  div{ }\t/ /  p\n{}\n/\tbr {}\n\n",
+			want:  "\n  div{ }\t/ /  p\n{}\n/\tbr {}\n\n",
+		},
+		{
+			name:  "Only whitespace",
+			input: "   ",
+			want:  "   ",
+		},
+		{
+			name:  "Attribute forms",
+			input: `a#x.y  .z href="/\"q\"" download {}`,
+			want:  `a#x.y  .z href="/\"q\"" download {}`,
+		},
+		{
+			name:  "Text bodies",
+			input: "p {-\n  Hi @ em{=there}, \\@you\n} q {=  x  }",
+			want:  "p {-\n  Hi @ em{=there}, \\@you\n} q {=  x  }",
+		},
+		{
+			name:  "Raw body",
+			input: "script { if (x) { y(\"}\") } }",
+			want:  "script { if (x) { y(\"}\") } }",
+		},
+		{
+			name:  "Modified attribute",
+			input: "a #x  href=\"/a\\\\b\" .c {}",
+			edit: func(nodes []ast.Node) {
+				nodes[0].Attributes[0].Value = "y z"
+			},
+			want: "a id=\"y z\"  href=\"/a\\\\b\" .c {}",
+		},
+		{
+			name:  "Removed and added attributes",
+			input: "a .b .c {}",
+			edit: func(nodes []ast.Node) {
+				nodes[0].Attributes.Set("class", "b")
+				nodes[0].Attributes.Add("id", "d")
+			},
+			want: `a .b id="d" {}`,
+		},
+		{
+			name:  "Modified trimmed text",
+			input: "p {- x }",
+			edit: func(nodes []ast.Node) {
+				nodes[0].Children[0].Name = " y"
+			},
+			want: "p {= y}",
+		},
+		{
+			name:  "Added node",
+			input: "div {\n\tp {}\n}",
+			edit: func(nodes []ast.Node) {
+				nodes[0].Children = append(nodes[0].Children,
+					ast.Node{Type: ast.Normal, Name: "hr"})
+			},
+			want: "div {\n\tp {}hr {}\n}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.ParseWithOptions(
+				strings.NewReader(tt.input), "-",
+				parser.Options{Trivia: true})
+			if err != nil {
+				t.Fatalf("ParseWithOptions() error = %v", err)
+			}
+			if tt.edit != nil {
+				tt.edit(nodes)
+			}
+
+			var buf strings.Builder
+			if err := WriteUntranslatedAST(&buf, nodes); err != nil {
+				t.Fatalf("WriteUntranslatedAST() error = %v", err)
+			}
+
+			/* The whitespace of a document without nodes is only held
+			   by the decoder */
+			if len(nodes) == 0 {
+				dec := parser.NewDecoder(strings.NewReader(tt.input), "-",
+					parser.Options{Trivia: true})
+				if _, err := dec.Next(); err != io.EOF {
+					t.Fatalf("Next() error = %v, want io.EOF", err)
+				}
+				buf.WriteString(dec.Trailing())
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("WriteUntranslatedAST() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,13 +4,16 @@ package formatter
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"html"
 	"io"
-	"maps"
 	"strings"
+	"time"
 
 	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
 )
 
 // Options configures the behavior of the HTML formatter.
@@ -22,76 +25,394 @@ type Options struct {
 	// Doctype specifies whether an HTML5 doctype declaration should
 	// be automatically prepended to the output.
 	Doctype bool
+	// Prolog, if non-empty, is written at the beginning of the output
+	// instead of the doctype declaration, regardless of Doctype.  It may
+	// contain a custom doctype declaration, an XML declaration, or
+	// both.
+	Prolog string
+	// XML specifies whether the output should be serialized as
+	// well-formed XML, such as for XHTML documents.  Void elements are
+	// then self-closed, boolean attributes are written as
+	// ‘attr="attr"’, text is escaped per the rules of XML, and the
+	// bodies of raw elements are wrapped in CDATA sections where
+	// required.  When minifying, only whitespace is collapsed.
+	XML bool
+	// EnvPolicy specifies which variables of the environment of the
+	// current process are passed on to macros.
+	EnvPolicy EnvPolicy
+	// EnvAllow lists the names of the variables passed on to macros
+	// when EnvPolicy is EnvAllowlist.
+	EnvAllow []string
+	// Env lists additional variables of the form ‘key=value’ to set
+	// in the environment of macros, regardless of EnvPolicy.  They take
+	// precedence over passed on variables, but not over the variables
+	// set by the formatter such as GSP_PATH.
+	Env []string
 	// SearchPath provides a list of directory paths to search when
 	// resolving the executables for macro nodes.
 	SearchPath []string
+	// Indent specifies the string with which to indent each level of
+	// nesting when pretty-printing.  If non-empty, block-level
+	// elements are laid out on their own lines.  Inline content and the
+	// contents of pre and textarea elements are never reformatted, so
+	// pretty-printing does not affect how the document is rendered.
+	Indent string
+	// Minify specifies whether the output should be made as small as
+	// possible without affecting how the document is rendered.  Optional
+	// end tags and the quotes around attribute values are omitted where
+	// permitted, the values of boolean attributes are removed, and runs
+	// of whitespace in text are collapsed.  Indent is ignored if Minify
+	// is set.
+	Minify bool
+	// MinifyRaw specifies whether the bodies of style and script
+	// elements containing CSS, JavaScript, or JSON should have their
+	// comments and insignificant whitespace removed.
+	MinifyRaw bool
+	// Stderr is the writer to which the standard error of macro
+	// executables is copied.  If nil, os.Stderr is used.
+	Stderr io.Writer
+	// Cache, if non-nil, caches the output of macros so that they need
+	// not be run again for the same input.
+	Cache *MacroCache
+	// MacroTimeout, if positive, is the maximum duration for which a
+	// macro may run before it is killed.
+	MacroTimeout time.Duration
+	// MaxMacroOutput, if positive, is the maximum number of bytes that
+	// a macro may write to its standard output before it is killed.
+	MaxMacroOutput int64
+	// MacroCPULimit, if positive, is the maximum CPU time that a macro
+	// may use before it is killed, rounded up to whole seconds.
+	// MacroMemoryLimit, if positive, is the maximum size in bytes of
+	// the virtual memory of a macro, beyond which its allocations fail.
+	// These limits are only supported on Linux, and are applied to
+	// each macro process immediately after it starts.  On other systems
+	// macros fail with ErrLimitsUnsupported if either is set.
+	MacroCPULimit    time.Duration
+	MacroMemoryLimit int64
+	// MacroWorkers specifies the maximum number of macros to run at
+	// once.  If greater than 1, macros are started ahead of the point
+	// at which their output is written, and their output is held in
+	// memory until it is.  Output is always written in source order,
+	// and an error is reported for the first failing macro in source
+	// order.  Macros within the output of other macros are run one at a
+	// time.
+	MacroWorkers int
+	// MaxMacroDepth is the maximum number of macro expansions that may
+	// be nested within one another, such as by a macro whose output
+	// invokes another macro.  If zero, DefaultMaxMacroDepth is used.
+	// Regardless of MaxMacroDepth, expanding a macro fails if it is
+	// being expanded already with the same attributes and body, as the
+	// expansion would never end.
+	MaxMacroDepth int
+	// Servers holds the running servers of macros that opted in with
+	// ServerMarker.  If nil, servers are started for each call to
+	// WriteAst or WriteStream and shut down before it returns.
+	// Sharing Servers between calls reuses the servers across
+	// documents, in which case the caller must close them.
+	Servers *MacroServers
+	// StopOnRecoveredError specifies whether WriteStream should stop
+	// once a recovering decoder has recovered from an error, without
+	// writing more output or running more macros.  WriteStream then
+	// returns dec.Err(), and the remainder of the document may be read
+	// from the decoder to find further errors.
+	StopOnRecoveredError bool
+	// SourceMap, if non-nil, has a mapping appended to it for each tag,
+	// run of text, and macro invocation written.
+	SourceMap *SourceMap
 }
 
+// EnvPolicy specifies which variables of the environment of the current
+// process are passed on to macros.
+type EnvPolicy int
+
+const (
+	// EnvInherit passes on the entire environment.
+	EnvInherit EnvPolicy = iota
+	// EnvAllowlist passes on only the variables named in
+	// Options.EnvAllow.
+	EnvAllowlist
+)
+
 // WriteAst formats a GSP AST as HTML and writes the resulting output
 // to the provided io.Writer.  The path parameter is passed to macro
 // executables via the GSP_PATH environment variable.
 func WriteAst(w io.Writer, path string, ast []ast.Node, opts Options) error {
-	if opts.Doctype {
-		if _, err := fmt.Fprint(w, "<!DOCTYPE html>"); err != nil {
+	return WriteAstContext(context.Background(), w, path, ast, opts)
+}
+
+// WriteAstContext is like WriteAst but stops formatting once ctx is
+// done, killing any running macro executables.  The returned error
+// then wraps ctx.Err().
+func WriteAstContext(ctx context.Context, w io.Writer, path string,
+	ast []ast.Node, opts Options) error {
+	if opts.Servers == nil {
+		opts.Servers = NewMacroServers()
+		defer opts.Servers.Close()
+	}
+	p := newPrinter(w, path, opts)
+	if p.runner = newMacroRunner(ctx, path, opts); p.runner != nil {
+		defer p.runner.close()
+		p.runner.todo = collectMacros(nil, ast, opts)
+	}
+	if err := writeProlog(p, opts); err != nil {
+		return err
+	}
+	if err := writeNodes(ctx, p, path, ast, opts); err != nil {
+		return err
+	}
+	return p.finish()
+}
+
+// WriteStream is like WriteAst, but formats the document produced by
+// the decoder dec as it is being read instead of a complete AST.  Only
+// the bodies of macros are read into memory in full, along with the
+// document between macros that are run concurrently.
+//
+// WriteStream does not report the errors that a recovering decoder
+// recovered from unless Options.StopOnRecoveredError is set; they
+// should be retrieved with dec.Err.
+func WriteStream(w io.Writer, path string, dec *parser.Decoder, opts Options) error {
+	return WriteStreamContext(context.Background(), w, path, dec, opts)
+}
+
+// WriteStreamContext is like WriteStream but stops formatting once ctx
+// is done, as with WriteAstContext.
+func WriteStreamContext(ctx context.Context, w io.Writer, path string,
+	dec *parser.Decoder, opts Options) error {
+	if opts.Servers == nil {
+		opts.Servers = NewMacroServers()
+		defer opts.Servers.Close()
+	}
+	p := newPrinter(w, path, opts)
+	src := eventSource{
+		dec:    dec,
+		runner: newMacroRunner(ctx, path, opts),
+		strict: opts.StopOnRecoveredError,
+	}
+	if p.runner = src.runner; p.runner != nil {
+		defer p.runner.close()
+	}
+	if err := writeProlog(p, opts); err != nil {
+		return err
+	}
+
+	/* Nodes that have been started but not yet ended.  The open tag of
+	   the innermost node is only written once all of its attributes
+	   have been read. */
+	var (
+		stack   []ast.Node
+		pending bool
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		it, err := src.next()
+		ev := it.ev
+		if err == io.EOF {
+			return p.finish()
+		} else if err != nil {
+			return err
+		}
+
+		if pending && ev.Kind != parser.Attribute {
+			pending = false
+			if ev.Kind == parser.EndNode {
+				/* The node has no children, so its span is known */
+				stack[len(stack)-1].Span = ev.Span
+			}
+			if err := writeOpenTag(p, stack[len(stack)-1]); err != nil {
+				return err
+			}
+		}
+
+		/* Children of void elements are never written */
+		if len(stack) != 0 && stack[len(stack)-1].Type == ast.Void {
+			switch {
+			case it.node != nil:
+				p.runner.discard()
+				continue
+			case ev.Kind == parser.StartNode, ev.Kind == parser.Comment:
+				if err := src.skip(); err != nil {
+					return err
+				}
+				continue
+			case ev.Kind == parser.Text:
+				continue
+			}
+		}
+
+		switch ev.Kind {
+		case parser.StartNode:
+			if isMacroStart(ev) {
+				node, err := src.readNode(it)
+				if err != nil {
+					return err
+				}
+				if p.runner != nil {
+					if it.node == nil {
+						p.runner.start(node)
+					}
+					src.readAhead()
+				}
+				if err := writeNode(ctx, p, path, node, opts); err != nil {
+					return err
+				}
+				continue
+			}
+			stack = append(stack, ast.Node{
+				Type: ev.Type,
+				Name: ev.Name,
+				Span: ev.Span,
+			})
+			pending = true
+		case parser.Attribute:
+			n := &stack[len(stack)-1]
+			n.Attributes.Add(ev.Name, ev.Value)
+		case parser.Comment:
+			if !opts.Comments {
+				if err := src.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			stack = append(stack, ast.Node{Type: ast.Comment})
+			err = writeCommentStart(p)
+		case parser.Text:
+			if stack[len(stack)-1].Type == ast.Raw {
+				err = writeRawText(p, stack[len(stack)-1], ev.Name, ev.Span)
+			} else {
+				err = writeText(p, html.EscapeString(ev.Name), ev.Span)
+			}
+		case parser.EndNode:
+			n := stack[len(stack)-1]
+			n.Span = ev.Span
+			stack = stack[:len(stack)-1]
+			switch n.Type {
+			case ast.Comment:
+				err = writeCommentEnd(p)
+			case ast.Void:
+			default:
+				err = writeCloseTag(p, n)
+			}
+		}
+		if err != nil {
 			return err
 		}
 	}
-	return writeNodes(w, path, ast, opts)
 }
 
-func writeNodes(w io.Writer, path string, ast []ast.Node, opts Options) error {
+func writeNodes(ctx context.Context, w *printer, path string,
+	ast []ast.Node, opts Options) error {
 	for _, n := range ast {
-		if err := writeNode(w, path, n, opts); err != nil {
+		if err := writeNode(ctx, w, path, n, opts); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func writeNode(w io.Writer, path string, node ast.Node, opts Options) error {
+func writeNode(ctx context.Context, w *printer, path string,
+	node ast.Node, opts Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	var e1, e2, e3 error
 
 	switch node.Type {
 	case ast.Comment:
 		if opts.Comments {
 			e1 = writeCommentStart(w)
-			e2 = writeNodes(w, path, node.Children, opts)
+			e2 = writeNodes(ctx, w, path, node.Children, opts)
 			e3 = writeCommentEnd(w)
 		}
 	case ast.Macro, ast.VerbatimMacro:
-		mpath, ok := findMacro(node.Name, opts.SearchPath)
-		if !ok {
-			return fmt.Errorf("%s: failed to find macro", node.Name)
+		/* Macro output is attributed to the invocation as a whole */
+		if err := w.resolve(follower{kind: followOther}); err != nil {
+			return err
 		}
-		e1 = execMacro(w, mpath, path, node, opts)
+		start := w.pos
+		err := w.expand(node, opts)
+		if err == nil {
+			err = writeMacro(ctx, w, path, node, opts)
+			w.expansions = w.expansions[:len(w.expansions)-1]
+		}
+
+		/* Errors ending an expansion are only reported once, for the
+		   outermost invocation */
+		var rerr MacroRecursionError
+		if err != nil && len(w.expansions) != 0 && errors.As(err, &rerr) {
+			return rerr
+		} else if err != nil {
+			/* Invocations within the output of a macro are located
+			   within that output */
+			where := path
+			if n := len(w.expansions); n != 0 {
+				where = outputPath(w.expansions[n-1].node)
+			}
+			return newMacroError(where, node, err)
+		}
+		w.record(MappingMacro, node.Span, start)
 	case ast.Normal, ast.Escapable:
 		e1 = writeOpenTag(w, node)
-		e2 = writeNodes(w, path, node.Children, opts)
+		e2 = writeNodes(ctx, w, path, node.Children, opts)
 		e3 = writeCloseTag(w, node)
 	case ast.Void:
 		e1 = writeOpenTag(w, node)
 	case ast.Raw:
 		e1 = writeOpenTag(w, node)
-		e2 = writeRawText(w, node.Children[0].Name)
+		/* Raw nodes have no children if the parser recovered from
+		   reaching the end of the file in their body */
+		if len(node.Children) != 0 {
+			e2 = writeRawText(w, node, node.Children[0].Name,
+				node.Children[0].Span)
+		}
 		e3 = writeCloseTag(w, node)
 	case ast.Text:
-		e1 = writeText(w, html.EscapeString(node.Name))
+		e1 = writeText(w, html.EscapeString(node.Name), node.Span)
 	}
 
 	return cmp.Or(e1, e2, e3)
 }
 
-func writeOpenTag(w io.Writer, node ast.Node) error {
+func writeProlog(w *printer, opts Options) error {
+	var err error
+	switch {
+	case opts.Prolog != "":
+		_, err = fmt.Fprint(w, opts.Prolog)
+	case opts.Doctype:
+		_, err = fmt.Fprint(w, "<!DOCTYPE html>")
+	}
+	return err
+}
+
+func writeOpenTag(w *printer, node ast.Node) error {
+	if err := w.beginElement(node); err != nil {
+		return err
+	}
+	start := w.pos
 	_, err := fmt.Fprintf(w, "<%s", node.Name)
 	if err != nil {
 		return err
 	}
 
-	for k, vs := range maps.All(node.Attributes) {
+	for k, vs := range node.Attributes.All() {
 		v := html.EscapeString(strings.Join(vs, " "))
-		if len(v) == 0 {
+		switch {
+		case w.xml:
+			if len(v) == 0 && booleanAttributes[k] {
+				v = k
+			}
+			_, err = fmt.Fprintf(w, ` %s="%s"`, k, xmlAttribute(v))
+		case len(v) == 0,
+			w.minify && booleanAttributes[k] && strings.EqualFold(v, k):
 			_, err = fmt.Fprintf(w, ` %s`, k)
-		} else {
+		case w.minify && unquotable(v):
+			_, err = fmt.Fprintf(w, ` %s=%s`, k, v)
+		default:
 			_, err = fmt.Fprintf(w, ` %s="%s"`, k, v)
 		}
 
@@ -100,39 +421,78 @@ func writeOpenTag(w io.Writer, node ast.Node) error {
 		}
 	}
 
-	_, err = fmt.Fprint(w, ">")
+	if w.xml && node.Type == ast.Void {
+		_, err = fmt.Fprint(w, "/>")
+	} else {
+		_, err = fmt.Fprint(w, ">")
+	}
+
+	i := w.record(MappingTag, node.Span, start)
+	if node.Type != ast.Void {
+		w.open[len(w.open)-1].mapping = i
+	}
 	return err
 }
 
-func writeCloseTag(w io.Writer, node ast.Node) error {
+func writeCloseTag(w *printer, node ast.Node) error {
+	if ok, err := w.endElement(node); !ok || err != nil {
+		return err
+	}
+	start := w.pos
 	_, err := fmt.Fprintf(w, "</%s>", node.Name)
+	w.record(MappingTag, node.Span, start)
 	return err
 }
 
-func writeCommentStart(w io.Writer) error {
+func writeCommentStart(w *printer) error {
+	if err := w.resolve(follower{kind: followComment}); err != nil {
+		return err
+	}
 	_, err := fmt.Fprint(w, "<!-- ")
+	w.comments++
 	return err
 }
 
-func writeCommentEnd(w io.Writer) error {
+func writeCommentEnd(w *printer) error {
+	w.comments--
 	_, err := fmt.Fprint(w, " -->")
 	return err
 }
 
-func writeRawText(w io.Writer, s string) error {
+func writeRawText(w *printer, node ast.Node, s string, span ast.Span) error {
+	if w.minifyRaw {
+		s = minifyRaw(node, s)
+	}
+	if w.xml {
+		s = xmlRawText(node, s)
+	}
+	start := w.pos
 	_, err := w.Write([]byte(s))
+	w.record(MappingText, span, start)
 	return err
 }
 
-func writeText(w io.Writer, s string) error {
-	bs := []byte(s)
-	for i := 0; i < len(bs); i++ {
-		if bs[i] == '\\' {
-			i++
-		}
-		if _, err := w.Write([]byte{bs[i]}); err != nil {
-			return err
+func writeText(w *printer, s string, span ast.Span) error {
+	if w.minify && w.frozen == 0 {
+		s = collapseSpace(s)
+		if s == " " && spacelessElements[w.parent()] {
+			return nil
 		}
 	}
+	if s == "" {
+		return nil
+	}
+	if w.xml {
+		s = xmlText(s)
+	}
+	if err := w.resolve(follower{kind: followText}); err != nil {
+		return err
+	}
+
+	start := w.pos
+	if _, err := w.Write([]byte(unescapeText(s))); err != nil {
+		return err
+	}
+	w.record(MappingText, span, start)
 	return nil
 }
@@ -1,10 +1,17 @@
 package formatter
 
 import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
 )
 
 func TestWriteAst(t *testing.T) {
@@ -32,8 +39,8 @@ func TestWriteAst(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "p",
-					Attributes: map[string][]string{
-						"id": {"x-p"},
+					Attributes: ast.Attributes{
+						{Key: "id", Value: "x-p"},
 					},
 					Children: []ast.Node{
 						{
@@ -52,8 +59,8 @@ func TestWriteAst(t *testing.T) {
 				{
 					Type: ast.Void,
 					Name: "img",
-					Attributes: map[string][]string{
-						"src": {"image.png"},
+					Attributes: ast.Attributes{
+						{Key: "src", Value: "image.png"},
 					},
 				},
 			},
@@ -117,14 +124,45 @@ func TestWriteAst(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "input",
-					Attributes: map[string][]string{
-						"disabled": {""},
+					Attributes: ast.Attributes{
+						{Key: "disabled", Value: ""},
 					},
 				},
 			},
 			opts: Options{},
 			want: `<input disabled></input>`,
 		},
+		{
+			name: "Attribute order",
+			nodes: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "p",
+					Attributes: ast.Attributes{
+						{Key: "data-z", Value: "1"},
+						{Key: "class", Value: "a"},
+						{Key: "id", Value: "b"},
+						{Key: "class", Value: "c"},
+						{Key: "data-a", Value: "2"},
+					},
+				},
+			},
+			opts: Options{},
+			want: `<p data-z="1" class="a c" id="b" data-a="2"></p>`,
+		},
+		{
+			name: "Text ending in a backslash",
+			nodes: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "p",
+					Children: []ast.Node{
+						{Type: ast.Text, Name: `a\@b \`},
+					},
+				},
+			},
+			want: `<p>a@b \</p>`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -141,3 +179,335 @@ func TestWriteAst(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteStream(t *testing.T) {
+	inputs := []string{
+		`html lang="en" { head { title {- Hi } } body { p {- a @em{-b} } } }`,
+		`br .x {} style { a { b: c } }`,
+		`div { / p {- hidden } span {=  x  } }`,
+	}
+
+	for _, input := range inputs {
+		for _, opts := range []Options{
+			{},
+			{Comments: true, Doctype: true},
+			{Doctype: true, Indent: "\t"},
+			{Doctype: true, Minify: true, MinifyRaw: true},
+			{Comments: true, XML: true, Prolog: "<?xml version=\"1.0\"?>"},
+		} {
+			nodes, err := parser.Parse(strings.NewReader(input), "<string>")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			var want strings.Builder
+			if err := WriteAst(&want, "<string>", nodes, opts); err != nil {
+				t.Fatalf("WriteAst() error = %v", err)
+			}
+
+			var got strings.Builder
+			dec := parser.NewDecoder(strings.NewReader(input), "<string>",
+				parser.Options{})
+			if err := WriteStream(&got, "<string>", dec, opts); err != nil {
+				t.Fatalf("WriteStream() error = %v", err)
+			}
+
+			if got.String() != want.String() {
+				t.Errorf("WriteStream() = %q, want %q", got.String(),
+					want.String())
+			}
+		}
+	}
+}
+
+func TestWriteStreamStopOnRecoveredError(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		var out, stderr strings.Builder
+		dec := parser.NewDecoder(strings.NewReader("p {} } $fail {} q {"),
+			"<string>", parser.Options{Recover: true})
+		err := WriteStream(&out, "<string>", dec, Options{
+			SearchPath:           []string{"testdata/macros"},
+			Stderr:               &stderr,
+			MacroWorkers:         workers,
+			StopOnRecoveredError: true,
+		})
+
+		var errs parser.ErrorList
+		if !errors.As(err, &errs) || len(errs) != 1 {
+			t.Errorf("WriteStream() error = %v, want 1 recovered error", err)
+		}
+		if got := out.String(); got != "<p></p>" {
+			t.Errorf("WriteStream() = %q, want %q", got, "<p></p>")
+		}
+		if stderr.Len() != 0 {
+			t.Errorf("macro after the error was run")
+		}
+
+		/* The remainder of the document may still be read */
+		for err = nil; err == nil; {
+			_, err = dec.Next()
+		}
+		if err != io.EOF {
+			t.Errorf("Next() error = %v, want io.EOF", err)
+		}
+		if errors.As(dec.Err(), &errs) && len(errs) != 2 {
+			t.Errorf("Err() = %v, want 2 errors", dec.Err())
+		}
+	}
+}
+
+func TestWriteAstIndent(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Document",
+			input: `html { head { meta charset="utf-8" {} title {-Hi} } body { p {-Hello @em{-world}} } }`,
+			want: "<!DOCTYPE html>\n<html>\n  <head>\n    <meta charset=\"utf-8\">" +
+				"\n    <title>Hi</title>\n  </head>\n  <body>\n" +
+				"    <p>Hello <em>world</em></p>\n  </body>\n</html>",
+		},
+		{
+			name:  "Inline content",
+			input: `div {- a @span{-b} c @p{-d} e }`,
+			want:  "<!DOCTYPE html>\n<div>a <span>b</span> c \n  <p>d</p> e\n</div>",
+		},
+		{
+			name:  "Preformatted content",
+			input: `div { pre { div { b {-x} } } textarea {- a } }`,
+			want: "<!DOCTYPE html>\n<div>\n  <pre><div><b>x</b></div></pre>" +
+				"<textarea>a</textarea>\n</div>",
+		},
+		{
+			name:  "Scripts",
+			input: `head { script {x()} } body { script {y()} }`,
+			want: "<!DOCTYPE html>\n<head>\n  <script>x()</script>\n</head>" +
+				"\n<body><script>y()</script></body>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "<string>")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			var got strings.Builder
+			opts := Options{Doctype: true, Indent: "  "}
+			if err := WriteAst(&got, "<string>", nodes, opts); err != nil {
+				t.Fatalf("WriteAst() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("WriteAst() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAstMinify(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Document",
+			input: `html { head { title {-Hi} } body { p {-a} } }`,
+			want:  "<html><head><title>Hi</title><body><p>a",
+		},
+		{
+			name:  "Paragraphs",
+			input: `div { p {-a} p {-b} span {-c} p {-d} } a { p {-e} }`,
+			want:  "<div><p>a<p>b</p><span>c</span><p>d</div><a><p>e</p></a>",
+		},
+		{
+			name:  "Lists and tables",
+			input: `ul { li {-a} li {-b} } dl { dt {-c} dd {-d} } table { tr { th {-e} td {-f} } }`,
+			want:  "<ul><li>a<li>b</ul><dl><dt>c<dd>d</dl><table><tr><th>e<td>f</table>",
+		},
+		{
+			name:  "Attributes",
+			input: `input #x .a .b disabled="DISABLED" checked="no" value="" title="a=b" {}`,
+			want:  `<input id=x class="a b" disabled checked=no value title="a=b">`,
+		},
+		{
+			name:  "Whitespace",
+			input: `p {=  a  @em{= b }  } ul {= } pre {=  a  } textarea {=  a  }`,
+			want:  "<p> a <em> b </em> <ul></ul><pre>  a  </pre><textarea>  a  </textarea>",
+		},
+		{
+			name:  "Comments",
+			input: `li {-a} / li {-b}`,
+			want:  "<li>a</li><!-- <li>b</li> -->",
+		},
+		{
+			name:  "Styles",
+			input: `style { a  >  b , c { color : red ; } /* x */ @media screen and (min-width: 1px) { d { e: calc(1px + 2px) } } }`,
+			want:  "<style>a>b,c{color :red;}@media screen and (min-width:1px){d{e:calc(1px + 2px)}}</style>",
+		},
+		{
+			name: "Scripts",
+			input: "script { // x\nlet a = b + +c; /* y */ if (d / e) return /f g/i.test(h)\ni()\n}" +
+				` script type="text/x-template" { a  b }`,
+			want: "<script>let a=b+ +c;if(d/e)return/f g/i.test(h)\ni()</script>" +
+				`<script type=text/x-template> a  b </script>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "<string>")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			var got strings.Builder
+			opts := Options{Comments: true, Minify: true, MinifyRaw: true}
+			if err := WriteAst(&got, "<string>", nodes, opts); err != nil {
+				t.Fatalf("WriteAst() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("WriteAst() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAstXML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		want  string
+	}{
+		{
+			name:  "Doctype",
+			input: `html {}`,
+			opts:  Options{Doctype: true},
+			want:  "<!DOCTYPE html><html></html>",
+		},
+		{
+			name:  "Prolog",
+			input: `feed {}`,
+			opts:  Options{Doctype: true, Prolog: `<?xml version="1.0" encoding="utf-8"?>`},
+			want:  `<?xml version="1.0" encoding="utf-8"?><feed></feed>`,
+		},
+		{
+			name:  "Void elements",
+			input: `p { br {} img src="x" {} }`,
+			want:  `<p><br/><img src="x"/></p>`,
+		},
+		{
+			name:  "Attributes",
+			input: `input disabled checked="" alt="" value="a\"b" {}`,
+			want:  `<input disabled="disabled" checked="checked" alt="" value="a&#34;b"/>`,
+		},
+		{
+			name:  "Text",
+			input: "p {- a < b & \x01 c }",
+			want:  "<p>a &lt; b &amp; \uFFFD c</p>",
+		},
+		{
+			name:  "Raw bodies",
+			input: `script { a && b } style { a > b { c: "&" } } script { a() } x-raw { <x/> ]]> }`,
+			opts:  Options{Minify: true},
+			want: "<script>//<![CDATA[\n a && b \n//]]></script>" +
+				"<style>/*<![CDATA[*/ a > b { c: \"&\" } /*]]>*/</style>" +
+				"<script> a() </script>" +
+				"<x-raw><![CDATA[ <x/> ]]]]><![CDATA[> ]]></x-raw>",
+		},
+		{
+			name:  "Comments",
+			input: `/ p {- a -- b - }`,
+			opts:  Options{Comments: true},
+			want:  "<!-- <p>a - - b -</p> -->",
+		},
+		{
+			name:  "Minified",
+			input: `ul { li {-  a  } li {-b} } input disabled {}`,
+			opts:  Options{Minify: true},
+			want:  `<ul><li>a</li><li>b</li></ul><input disabled="disabled"/>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			popts := parser.Options{Elements: map[string]parser.Element{
+				"x-raw": {Type: ast.Raw, Lexer: parser.LexBraces},
+			}}
+			nodes, err := parser.ParseWithOptions(strings.NewReader(tt.input),
+				"<string>", popts)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			var got strings.Builder
+			opts := tt.opts
+			opts.XML = true
+			if err := WriteAst(&got, "<string>", nodes, opts); err != nil {
+				t.Fatalf("WriteAst() error = %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("WriteAst() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroError(t *testing.T) {
+	input := "div {\n\tp {- @$$missing{} }\n}"
+	dec := parser.NewDecoder(strings.NewReader(input), "x.gsp",
+		parser.Options{})
+	err := WriteStream(io.Discard, "x.gsp", dec, Options{})
+
+	var merr MacroError
+	if !errors.As(err, &merr) {
+		t.Fatalf("WriteStream() error = %v, want a MacroError", err)
+	}
+	if !errors.Is(err, ErrMacroNotFound) {
+		t.Errorf("WriteStream() error = %v, want %v", err, ErrMacroNotFound)
+	}
+
+	var perr parser.Error = merr
+	want := ast.Span{
+		Start: ast.Position{Offset: 13, Line: 2, Column: 8},
+		End:   ast.Position{Offset: 22, Line: 2, Column: 17},
+	}
+	if got := perr.Position(); got.Path != "x.gsp" || got.Span != want {
+		t.Errorf("Position() = %+v, want %v in x.gsp", got, want)
+	}
+	if perr.Code() != "macro" {
+		t.Errorf("Code() = %q, want %q", perr.Code(), "macro")
+	}
+}
+
+func TestWriteAstContext(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat >/dev/null\nexec sleep 60\n"
+	err := os.WriteFile(filepath.Join(dir, "sleep"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := parser.Parse(strings.NewReader("div { $sleep{} }"), "x.gsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = WriteAstContext(ctx, io.Discard, "x.gsp", nodes,
+		Options{SearchPath: []string{dir}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WriteAstContext() error = %v, want %v",
+			err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("WriteAstContext() took %v after cancellation", d)
+	}
+}
@@ -0,0 +1,63 @@
+package formatter
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func checkLimits() error { return nil }
+
+// setLimits applies the resource limits in opts to the started macro
+// with the process ID pid.
+func setLimits(pid int, opts Options) error {
+	if opts.MacroCPULimit > 0 {
+		/* The limit is in whole seconds.  The process is sent SIGXCPU
+		   when it reaches the soft limit, and SIGKILL a second later if
+		   it survives. */
+		secs := uint64((opts.MacroCPULimit + 999999999) / 1e9)
+		lim := syscall.Rlimit{Cur: secs, Max: secs + 1}
+		if err := prlimit(pid, syscall.RLIMIT_CPU, &lim); err != nil {
+			return err
+		}
+	}
+	if opts.MacroMemoryLimit > 0 {
+		n := uint64(opts.MacroMemoryLimit)
+		lim := syscall.Rlimit{Cur: n, Max: n}
+		if err := prlimit(pid, syscall.RLIMIT_AS, &lim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prlimit(pid, resource int, lim *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid),
+		uintptr(resource), uintptr(unsafe.Pointer(lim)), 0, 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError("prlimit", errno)
+	}
+	return nil
+}
+
+// limitError returns the error describing the resource limit the
+// exited macro with the process state ps exceeded, if any.  Exceeding
+// the memory limit causes allocations to fail rather than the process
+// to be killed, so it cannot be told apart from other failures.
+func limitError(ps *os.ProcessState, opts Options) error {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || opts.MacroCPULimit <= 0 {
+		return nil
+	}
+	switch ws.Signal() {
+	case syscall.SIGKILL:
+		/* The hard limit was reached, unless killed by someone else */
+		if ps.UserTime()+ps.SystemTime() < opts.MacroCPULimit {
+			break
+		}
+		fallthrough
+	case syscall.SIGXCPU:
+		return MacroCPUTimeError{opts.MacroCPULimit}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package formatter
+
+import "os"
+
+func checkLimits() error { return ErrLimitsUnsupported }
+
+func setLimits(pid int, opts Options) error              { return nil }
+func limitError(ps *os.ProcessState, opts Options) error { return nil }
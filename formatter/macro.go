@@ -1,18 +1,86 @@
 package formatter
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"git.thomasvoss.com/gsp/v4/ast"
 	"git.thomasvoss.com/gsp/v4/parser"
 )
 
+// macroExecutable is an executable implementing a macro.
+type macroExecutable struct {
+	path    string
+	size    int64
+	mod     time.Time
+	sum     string /* The SHA-256 hash of the executable in hex */
+	nocache bool   /* The macro opted out of caching */
+	json    bool   /* The macro uses the JSON protocol */
+	server  bool   /* The macro is run as a server */
+}
+
+// Executables already inspected, which are inspected again if they
+// change
+var executables = struct {
+	sync.Mutex
+	m map[string]macroExecutable
+}{m: make(map[string]macroExecutable)}
+
+// loadMacro finds the executable of the macro name in dirs and
+// inspects it for the markers it contains.
+func loadMacro(name string, dirs []string) (macroExecutable, error) {
+	path, ok := findMacro(name, dirs)
+	if !ok {
+		return macroExecutable{}, ErrMacroNotFound
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return macroExecutable{}, err
+	}
+
+	executables.Lock()
+	exe, ok := executables.m[path]
+	executables.Unlock()
+	if ok && exe.size == info.Size() && exe.mod.Equal(info.ModTime()) {
+		return exe, nil
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return macroExecutable{}, err
+	}
+	sum := sha256.Sum256(bs)
+	exe = macroExecutable{
+		path:    path,
+		size:    info.Size(),
+		mod:     info.ModTime(),
+		sum:     hex.EncodeToString(sum[:]),
+		nocache: bytes.Contains(bs, []byte(NoCacheMarker)),
+		json:    bytes.Contains(bs, []byte(JSONMarker)),
+		server:  bytes.Contains(bs, []byte(ServerMarker)),
+	}
+
+	executables.Lock()
+	executables.m[path] = exe
+	executables.Unlock()
+	return exe, nil
+}
+
 func findMacro(name string, dirs []string) (string, bool) {
 	for _, dir := range dirs {
 		path := filepath.Join(dir, name)
@@ -26,64 +94,408 @@ func findMacro(name string, dirs []string) (string, bool) {
 	return "", false
 }
 
-func execMacro(out io.Writer, mpath, fpath string,
-	node ast.Node, opts Options) error {
-	verbatim := node.Type == ast.VerbatimMacro
+// DefaultMaxMacroDepth is the maximum number of nested macro expansions
+// if Options.MaxMacroDepth is zero.
+const DefaultMaxMacroDepth = 64
+
+// expansion is a macro being expanded.
+type expansion struct {
+	node ast.Node
+	key  [sha256.Size]byte /* Identifies the macro, attributes, and body */
+}
 
-	env := os.Environ()
-	for k, v := range maps.All(node.Attributes) {
-		env = append(env, fmt.Sprintf("GSP_%s=%s",
-			strings.ToUpper(strings.ReplaceAll(k, "-", "_")),
-			strings.Join(v, " ")))
+// expand adds the macro node to the macros being expanded by w, failing
+// if the expansion would recurse too deeply or never end.
+func (w *printer) expand(node ast.Node, opts Options) error {
+	h := sha256.New()
+	field := func(s string) {
+		fmt.Fprintf(h, "%d:%s,", len(s), s)
 	}
-	if len(node.Children) != 0 && node.Children[0].Type == ast.Text {
-		env = append(env, "GSP_TEXT_P=1")
-	} else {
-		env = append(env, "GSP_TEXT_P=0")
+	field(invocation(node))
+	for _, a := range node.Attributes {
+		field(a.Key)
+		field(a.Value)
 	}
-	env = append(env, fmt.Sprintf("GSP_PATH=%s", fpath))
+	var body bytes.Buffer
+	if err := WriteUntranslatedAST(&body, node.Children); err != nil {
+		return err
+	}
+	field(body.String())
 
-	cmd := exec.Cmd{
-		Path:   mpath,
-		Env:    env,
-		Stderr: os.Stderr,
+	e := expansion{node: node}
+	h.Sum(e.key[:0])
+
+	chain := func() []string {
+		var names []string
+		for _, e := range w.expansions {
+			names = append(names, invocation(e.node))
+		}
+		return append(names, invocation(node))
 	}
-	stdin, err := cmd.StdinPipe()
+	for _, f := range w.expansions {
+		if f.key == e.key {
+			return MacroRecursionError{Chain: chain()}
+		}
+	}
+	limit := cmp.Or(opts.MaxMacroDepth, DefaultMaxMacroDepth)
+	if len(w.expansions) >= limit {
+		return MacroRecursionError{Chain: chain(), Limit: limit}
+	}
+
+	w.expansions = append(w.expansions, e)
+	return nil
+}
+
+// writeMacro expands the macro node into w.  Macros started ahead of
+// time by the runner of w are only awaited.
+func writeMacro(ctx context.Context, w *printer, fpath string,
+	node ast.Node, opts Options) error {
+	/* Macros within the output of other macros are not started ahead
+	   of time, as their output is not known until it is written */
+	if w.runner != nil && len(w.expansions) == 1 {
+		return w.runner.take().write(ctx, w, fpath, opts)
+	}
+
+	exe, err := loadMacro(node.Name, opts.SearchPath)
 	if err != nil {
 		return err
 	}
+	stderr := &tailWriter{w: stderrOf(opts)}
+	err = execMacro(ctx, exe, fpath, node, opts, stderr,
+		func(r io.Reader) error {
+			if node.Type == ast.VerbatimMacro {
+				_, err := io.Copy(w, r)
+				return err
+			}
+			nodes, err := parseMacroOutput(ctx, r, exe, node)
+			if err != nil {
+				return err
+			}
+			return writeNodes(ctx, w, fpath, nodes, opts)
+		})
+	if err != nil {
+		return macroFailure{exe.path, stderr.String(), err}
+	}
+	return nil
+}
+
+// parseMacroOutput parses the output r of the regular macro exe for
+// node.
+func parseMacroOutput(ctx context.Context, r io.Reader,
+	exe macroExecutable, node ast.Node) ([]ast.Node, error) {
+	if exe.json {
+		return readMacroResponse(r)
+	}
+	return parser.ParseContext(ctx, r, outputPath(node), parser.Options{})
+}
+
+// writeMacroInput writes the input of the macro exe for node to w.
+func writeMacroInput(w io.Writer, exe macroExecutable, fpath string,
+	node ast.Node) error {
+	if exe.json {
+		return writeMacroRequest(w, fpath, node)
+	}
+	return WriteUntranslatedAST(w, node.Children)
+}
+
+// stderrOf returns the writer to which the standard error of macros is
+// copied.
+func stderrOf(opts Options) io.Writer {
+	if opts.Stderr == nil {
+		return os.Stderr
+	}
+	return opts.Stderr
+}
 
-	var stdout io.ReadCloser
-	if verbatim {
-		cmd.Stdout = out
-	} else {
-		stdout, err = cmd.StdoutPipe()
+// execMacro runs the macro executable exe for node, passing its
+// standard output to consume.  The standard error of the macro is
+// copied to stderr.  If the output of the macro is cached, the cached
+// output is passed to consume instead.
+func execMacro(ctx context.Context, exe macroExecutable, fpath string,
+	node ast.Node, opts Options, stderr io.Writer,
+	consume func(io.Reader) error) error {
+	var cw *cacheWriter
+	if opts.Cache != nil {
+		key, err := opts.Cache.key(exe, node)
 		if err != nil {
 			return err
 		}
+		if key != "" {
+			if f, err := opts.Cache.open(key); err == nil {
+				defer f.Close()
+				return consume(f)
+			}
+			if cw, err = opts.Cache.create(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := runMacro(ctx, exe, fpath, node, opts, stderr,
+		func(r io.Reader) error {
+			if cw == nil {
+				return consume(r)
+			}
+			/* The whole output is cached even if not all of it is
+			   consumed */
+			r = io.TeeReader(r, cw)
+			if err := consume(r); err != nil {
+				return err
+			}
+			_, err := io.Copy(io.Discard, r)
+			return err
+		})
+	if cw != nil {
+		if err != nil {
+			cw.abort()
+		} else {
+			err = cw.commit()
+		}
+	}
+	return err
+}
+
+// runMacro is like execMacro but always runs the macro, subject to the
+// limits in opts.
+func runMacro(ctx context.Context, exe macroExecutable, fpath string,
+	node ast.Node, opts Options, stderr io.Writer,
+	consume func(io.Reader) error) error {
+	if exe.server {
+		return opts.Servers.run(ctx, exe, fpath, node, opts, stderr, consume)
+	}
+	if opts.MacroCPULimit > 0 || opts.MacroMemoryLimit > 0 {
+		if err := checkLimits(); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := attributeEnv(node)
+	if err != nil {
+		return err
+	}
+	/* Only the attributes of this invocation are visible, even to
+	   macros run by a macro */
+	env := slices.DeleteFunc(macroEnv(opts), func(kv string) bool {
+		return strings.HasPrefix(kv, "GSP_ATTR")
+	})
+	env = append(env, attrs...)
+	env = append(env, "GSP_TEXT_P="+textP(node))
+	env = append(env, fmt.Sprintf("GSP_PATH=%s", fpath))
+
+	/* Distinguish the macro timing out from the formatter being
+	   cancelled */
+	parent := ctx
+	if opts.MacroTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.MacroTimeout,
+			MacroTimeoutError{opts.MacroTimeout})
+		defer cancel()
+	}
+
+	/* The process is killed if ctx is done before it exits */
+	cmd := exec.CommandContext(ctx, exe.path)
+	cmd.Env = env
+	cmd.Stderr = stderr
+	setupProcess(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
 	}
 
 	if err = cmd.Start(); err != nil {
 		return err
 	}
-	if err = WriteUntranslatedAST(stdin, node.Children); err != nil {
+	if err = setLimits(cmd.Process.Pid, opts); err != nil {
+		killProcess(cmd)
+		cmd.Wait()
 		return err
 	}
-	stdin.Close()
 
-	if !verbatim {
-		nodes, err := parser.Parse(stdout,
-			fmt.Sprintf("<$%s(%s)>", mpath, fpath))
-		if err != nil {
-			return err
+	/* Feed the body to the macro while its output is being consumed, as
+	   the macro may not read all of its input before writing output */
+	fed := make(chan error, 1)
+	go func() {
+		err := writeMacroInput(stdin, exe, fpath, node)
+		fed <- cmp.Or(err, stdin.Close())
+	}()
+
+	var out io.Reader = stdout
+	if opts.MaxMacroOutput > 0 {
+		out = &outputLimiter{r: stdout, n: opts.MaxMacroOutput,
+			limit: opts.MaxMacroOutput}
+	}
+	err = consume(out)
+
+	/* The macro may block writing output that is no longer read */
+	if err != nil {
+		killProcess(cmd)
+	}
+	werr := cmd.Wait()
+	ferr := <-fed
+
+	/* A macro need not read all of its input */
+	if errors.Is(ferr, syscall.EPIPE) || errors.Is(ferr, os.ErrClosed) {
+		ferr = nil
+	}
+
+	/* Report why the macro was killed rather than how it died */
+	var oerr MacroOutputError
+	switch {
+	case parent.Err() != nil:
+		return parent.Err()
+	case ctx.Err() != nil:
+		return context.Cause(ctx)
+	case errors.As(err, &oerr):
+		return oerr
+	case err != nil:
+		return err
+	}
+	if werr != nil {
+		return cmp.Or(limitError(cmd.ProcessState, opts), werr)
+	}
+	return ferr
+}
+
+// attributeEnv returns the variables exposing the attributes of the
+// macro node.  For each distinct attribute, GSP_ATTR_<NAME> holds its
+// values joined by spaces, GSP_ATTR_<NAME>__N the number of values,
+// and GSP_ATTR_<NAME>__<I> the Ith value.  As envName never produces
+// two underscores in a row, these never collide with the variables of
+// other attributes.  GSP_ATTRS lists the names of the
+// attributes in the order in which they first occur.  It fails if two
+// attributes would set the same variable.
+func attributeEnv(node ast.Node) ([]string, error) {
+	var (
+		env   []string
+		names []string
+		set   = make(map[string]string) /* Variables to attribute names */
+	)
+	add := func(name, k, v string) error {
+		if other, ok := set[k]; ok {
+			return AttributeCollisionError{[2]string{other, name}, k}
 		}
-		if err = writeNodes(out, fpath, nodes, opts); err != nil {
-			return err
+		set[k] = name
+		env = append(env, k+"="+v)
+		return nil
+	}
+
+	for name, vs := range node.Attributes.All() {
+		names = append(names, name)
+		k := "GSP_ATTR_" + envName(name)
+		if err := add(name, k, strings.Join(vs, " ")); err != nil {
+			return nil, err
+		}
+		if err := add(name, k+"__N", strconv.Itoa(len(vs))); err != nil {
+			return nil, err
+		}
+		for i, v := range vs {
+			if err := add(name, fmt.Sprintf("%s__%d", k, i+1), v); err != nil {
+				return nil, err
+			}
 		}
 	}
-	if err = cmd.Wait(); err != nil {
-		return err
+	return append(env, "GSP_ATTRS="+strings.Join(names, " ")), nil
+}
+
+// envName returns the attribute name in the form used in the names of
+// environment variables, uppercased and with each run of characters
+// other than ASCII letters and digits replaced with one underscore.
+func envName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+			sb.WriteRune(r - 'a' + 'A')
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case !strings.HasSuffix(sb.String(), "_"):
+			sb.WriteByte('_')
+		}
 	}
+	return sb.String()
+}
 
-	return nil
+// macroEnv returns the environment of macros without the variables set
+// by the formatter, as given by the environment policy of opts.
+func macroEnv(opts Options) []string {
+	var env []string
+	switch opts.EnvPolicy {
+	case EnvInherit:
+		env = os.Environ()
+	case EnvAllowlist:
+		for _, k := range opts.EnvAllow {
+			if v, ok := os.LookupEnv(k); ok {
+				env = append(env, k+"="+v)
+			}
+		}
+	}
+	/* Later variables take precedence over earlier ones */
+	return append(env, opts.Env...)
+}
+
+// tailWriter writes to w, holding enough of the end of what was written
+// for stderrTail.
+type tailWriter struct {
+	w    io.Writer
+	mu   sync.Mutex
+	tail []byte
+}
+
+func (t *tailWriter) Write(bs []byte) (int, error) {
+	t.mu.Lock()
+	t.tail = append(t.tail, bs...)
+	/* Trimmed only once well past the limit to not copy the tail on
+	   every write, keeping one byte more than stderrTail returns so that
+	   it still sees that the start was cut off */
+	if len(t.tail) > 2*maxStderrTail {
+		n := len(t.tail) - maxStderrTail - 1
+		t.tail = append(t.tail[:0], t.tail[n:]...)
+	}
+	t.mu.Unlock()
+	return t.w.Write(bs)
+}
+
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return stderrTail(t.tail)
+}
+
+// stderrTail returns the last maxStderrTail bytes of stderr, beginning
+// at the start of a line if any were cut off.
+func stderrTail(stderr []byte) string {
+	if len(stderr) <= maxStderrTail {
+		return string(stderr)
+	}
+	stderr = stderr[len(stderr)-maxStderrTail:]
+	if i := bytes.IndexByte(stderr, '\n'); i != -1 {
+		stderr = stderr[i+1:]
+	}
+	return string(stderr)
+}
+
+// outputLimiter reads from r, failing with a MacroOutputError once more
+// than limit bytes have been read.
+type outputLimiter struct {
+	r        io.Reader
+	n, limit int64 /* n is the number of bytes that may yet be read */
+}
+
+func (l *outputLimiter) Read(bs []byte) (int, error) {
+	/* Read one byte more than permitted to detect exceeding the limit */
+	if int64(len(bs)) > l.n+1 {
+		bs = bs[:l.n+1]
+	}
+	n, err := l.r.Read(bs)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, MacroOutputError{l.limit}
+	}
+	l.n -= int64(n)
+	return n, err
 }
@@ -0,0 +1,877 @@
+package formatter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+func TestMacroIO(t *testing.T) {
+	/* Large enough to fill any pipe buffer many times over */
+	body := strings.Repeat("p {-lorem ipsum dolor sit amet} ", 1<<15)
+	nodes, err := parser.Parse(strings.NewReader(body), "<string>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var html, gsp strings.Builder
+	if err := WriteAst(&html, "<string>", nodes, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteUntranslatedAST(&gsp, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 100000
+	var flood, floodHTML strings.Builder
+	for i := range count {
+		fmt.Fprintf(&flood, "p {-%d}\n", i)
+		fmt.Fprintf(&floodHTML, "<p>%d</p>", i)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		stderr string
+	}{
+		{
+			name:  "Large body echoed",
+			input: "$cat {" + body + "}",
+			want:  html.String(),
+		},
+		{
+			name:  "Large body echoed verbatim",
+			input: "$$cat {" + body + "}",
+			want:  gsp.String(),
+		},
+		{
+			name:  "Large output",
+			input: fmt.Sprintf("$flood count=\"%d\" {}", count),
+			want:  floodHTML.String(),
+		},
+		{
+			name:  "Large output verbatim",
+			input: fmt.Sprintf("$$flood count=\"%d\" {}", count),
+			want:  flood.String(),
+		},
+		{
+			name:  "Large body ignored",
+			input: "$ignore {" + body + "}",
+			want:  "<p>ignored</p>",
+		},
+		{
+			name:  "Large body ignored verbatim",
+			input: "$$ignore {" + body + "}",
+			want:  "p {-ignored}\n",
+		},
+		{
+			name:   "Large standard error",
+			input:  "$complain {" + body + "}",
+			stderr: gsp.String(),
+		},
+		{
+			name:   "Large standard error verbatim",
+			input:  "$$complain {" + body + "}",
+			stderr: gsp.String(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			/* Fail instead of hanging if the macro deadlocks */
+			ctx, cancel := context.WithTimeout(context.Background(),
+				30*time.Second)
+			defer cancel()
+
+			var out, stderr strings.Builder
+			dec := parser.NewDecoder(strings.NewReader(tt.input),
+				"<string>", parser.Options{})
+			err := WriteStreamContext(ctx, &out, "<string>", dec, Options{
+				SearchPath: []string{"testdata/macros"},
+				Stderr:     &stderr,
+			})
+			if err != nil {
+				t.Fatalf("WriteStreamContext() error = %v", err)
+			}
+
+			if got := out.String(); got != tt.want {
+				t.Errorf("output has length %d, want %d",
+					len(got), len(tt.want))
+			}
+			if got := stderr.String(); got != tt.stderr {
+				t.Errorf("standard error has length %d, want %d",
+					len(got), len(tt.stderr))
+			}
+		})
+	}
+}
+
+func TestMacroFailure(t *testing.T) {
+	for _, input := range []string{"$fail { p {-x} }", "$$fail { p {-x} }"} {
+		var stderr bytes.Buffer
+		dec := parser.NewDecoder(strings.NewReader(input), "<string>",
+			parser.Options{})
+		err := WriteStream(&strings.Builder{}, "<string>", dec, Options{
+			SearchPath: []string{"testdata/macros"},
+			Stderr:     &stderr,
+		})
+
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+			t.Errorf("%s: WriteStream() error = %v, want exit status 3",
+				input, err)
+		}
+		if got := stderr.String(); got != "oops\n" {
+			t.Errorf("%s: standard error = %q, want %q", input, got, "oops\n")
+		}
+	}
+}
+
+func TestMacroWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string /* Name of the failing macro */
+	}{
+		{
+			name: "Ordered output",
+			input: `$slow seconds="1" { p {-a} } br {} ` +
+				`$$slow seconds="0.5" { p {-b} } ` +
+				`div { $slow seconds="0" { p {-c} } } ` +
+				`$$slow seconds="1" {-d}`,
+			want: "<p>a</p><br>p {=b}<div><p>c</p></div>d",
+		},
+		{
+			name: "Skipped macros",
+			input: `$slow seconds="0" { p {-a} } / $sleep seconds="5" {} ` +
+				`/ div { $$sleep seconds="5" {} } p {-c}`,
+			want: "<p>a</p><p>c</p>",
+		},
+		{
+			name:    "First error reported",
+			input:   `$slow seconds="1" { p {-a} } $fail {} $missing {}`,
+			wantErr: "fail",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "<string>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := Options{
+				SearchPath:   []string{"testdata/macros"},
+				Stderr:       &bytes.Buffer{},
+				MacroWorkers: 4,
+			}
+
+			for _, stream := range []bool{false, true} {
+				var out strings.Builder
+				start := time.Now()
+				if stream {
+					dec := parser.NewDecoder(strings.NewReader(tt.input),
+						"<string>", parser.Options{})
+					err = WriteStream(&out, "<string>", dec, opts)
+				} else {
+					err = WriteAst(&out, "<string>", nodes, opts)
+				}
+				d := time.Since(start)
+
+				var merr MacroError
+				switch {
+				case tt.wantErr == "" && err != nil:
+					t.Errorf("stream = %v: error = %v", stream, err)
+				case tt.wantErr != "" &&
+					(!errors.As(err, &merr) || merr.Name != tt.wantErr):
+					t.Errorf("stream = %v: error = %v, want an error for "+
+						"macro ‘%s’", stream, err, tt.wantErr)
+				case tt.wantErr == "" && out.String() != tt.want:
+					t.Errorf("stream = %v: output = %q, want %q", stream,
+						out.String(), tt.want)
+				}
+
+				/* The macros run concurrently, so the slowest ones
+				   should take no longer than the slowest alone */
+				if d > 1900*time.Millisecond {
+					t.Errorf("stream = %v: took %v", stream, d)
+				}
+			}
+		})
+	}
+}
+
+func TestMacroLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		opts     Options
+		linux    bool
+		wantErr  error
+		wantCode string
+	}{
+		{
+			name:     "Timeout",
+			input:    `$slow seconds="10" {}`,
+			opts:     Options{MacroTimeout: 200 * time.Millisecond},
+			wantErr:  MacroTimeoutError{200 * time.Millisecond},
+			wantCode: "macro-timeout",
+		},
+		{
+			name:  "Within timeout",
+			input: `$slow seconds="0" { p {-a} }`,
+			opts:  Options{MacroTimeout: 10 * time.Second},
+		},
+		{
+			name:     "Output too large",
+			input:    `$flood count="1000" {}`,
+			opts:     Options{MaxMacroOutput: 100},
+			wantErr:  MacroOutputError{100},
+			wantCode: "macro-output",
+		},
+		{
+			name:     "Verbatim output too large",
+			input:    `$$flood count="1000" {}`,
+			opts:     Options{MaxMacroOutput: 100},
+			wantErr:  MacroOutputError{100},
+			wantCode: "macro-output",
+		},
+		{
+			name:  "Output at limit",
+			input: `$$flood count="10" {}`,
+			opts:  Options{MaxMacroOutput: 70},
+		},
+		{
+			name:     "CPU time",
+			input:    `$spin {}`,
+			opts:     Options{MacroCPULimit: time.Second},
+			linux:    true,
+			wantErr:  MacroCPUTimeError{time.Second},
+			wantCode: "macro-cpu-time",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linux && runtime.GOOS != "linux" {
+				t.Skip("resource limits are only supported on Linux")
+			}
+
+			/* Fail instead of hanging if the macro is not killed */
+			ctx, cancel := context.WithTimeout(context.Background(),
+				30*time.Second)
+			defer cancel()
+
+			opts := tt.opts
+			opts.SearchPath = []string{"testdata/macros"}
+			dec := parser.NewDecoder(strings.NewReader(tt.input),
+				"x.gsp", parser.Options{})
+			start := time.Now()
+			err := WriteStreamContext(ctx, io.Discard, "x.gsp", dec, opts)
+
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("WriteStreamContext() error = %v", err)
+				}
+				return
+			}
+			var merr MacroError
+			if !errors.As(err, &merr) || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WriteStreamContext() error = %v, want %v",
+					err, tt.wantErr)
+			}
+			if merr.Where.Row != 1 || merr.Code() != tt.wantCode {
+				t.Errorf("error at line %d with code %q, want line 1 "+
+					"with code %q", merr.Where.Row, merr.Code(), tt.wantCode)
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("WriteStreamContext() took %v", d)
+			}
+		})
+	}
+}
+
+func TestMacroEnv(t *testing.T) {
+	t.Setenv("GSP_TEST_KEPT", "kept")
+	t.Setenv("GSP_TEST_SECRET", "secret")
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "Inherited",
+			want: []string{"GSP_TEST_KEPT=kept", "GSP_TEST_SECRET=secret"},
+		},
+		{
+			name: "Allowlist",
+			opts: Options{
+				EnvPolicy: EnvAllowlist,
+				EnvAllow:  []string{"GSP_TEST_KEPT", "GSP_TEST_UNSET"},
+			},
+			want:    []string{"GSP_TEST_KEPT=kept"},
+			notWant: []string{"GSP_TEST_SECRET=", "GSP_TEST_UNSET="},
+		},
+		{
+			name:    "Empty allowlist",
+			opts:    Options{EnvPolicy: EnvAllowlist},
+			notWant: []string{"GSP_TEST_KEPT=", "GSP_TEST_SECRET="},
+		},
+		{
+			name: "Additions",
+			opts: Options{
+				EnvPolicy: EnvAllowlist,
+				EnvAllow:  []string{"GSP_TEST_KEPT"},
+				Env: []string{"GSP_TEST_KEPT=changed", "LANG=C",
+					"GSP_ATTR_X=y", "GSP_ATTR_Y=y"},
+			},
+			want: []string{"GSP_TEST_KEPT=changed", "LANG=C",
+				"GSP_ATTR_X=x"},
+			notWant: []string{"GSP_TEST_KEPT=kept", "GSP_ATTR_X=y",
+				"GSP_ATTR_Y="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			opts := tt.opts
+			opts.SearchPath = []string{"testdata/macros"}
+			dec := parser.NewDecoder(strings.NewReader(`$$printenv x="x" {}`),
+				"x.gsp", parser.Options{})
+			if err := WriteStream(&out, "x.gsp", dec, opts); err != nil {
+				t.Fatalf("WriteStream() error = %v", err)
+			}
+
+			lines := strings.Split(out.String(), "\n")
+			has := func(s string) bool {
+				for _, l := range lines {
+					if strings.HasPrefix(l, s) {
+						return true
+					}
+				}
+				return false
+			}
+			for _, s := range append(tt.want, "GSP_PATH=x.gsp") {
+				if !has(s) {
+					t.Errorf("environment lacks %q", s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if has(s) {
+					t.Errorf("environment has %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestMacroJSON(t *testing.T) {
+	input := "div {\n\t$$json-echo x=\"1\" .a x=\"2\" { p #b {-hi\\@x} }\n}"
+	var out strings.Builder
+	dec := parser.NewDecoder(strings.NewReader(input), "x.gsp",
+		parser.Options{})
+	err := WriteStream(&out, "x.gsp", dec, Options{
+		SearchPath: []string{"testdata/macros"},
+	})
+	if err != nil {
+		t.Fatalf("WriteStream() error = %v", err)
+	}
+
+	got := out.String()
+	got = strings.TrimPrefix(got, "<div>")
+	got = strings.TrimSuffix(got, "</div>")
+	var req MacroRequest
+	if err := json.Unmarshal([]byte(got), &req); err != nil {
+		t.Fatalf("invalid request %q: %v", got, err)
+	}
+
+	var clear func([]JSONNode)
+	clear = func(jns []JSONNode) {
+		for i := range jns {
+			if jns[i].Span == nil {
+				t.Errorf("node %+v has no span", jns[i])
+			}
+			jns[i].Span = nil
+			clear(jns[i].Children)
+		}
+	}
+	clear(req.Body)
+
+	want := MacroRequest{
+		Version:  MacroRequestVersion,
+		Name:     "json-echo",
+		Verbatim: true,
+		Attributes: []JSONAttribute{
+			{"x", "1"}, {"class", "a"}, {"x", "2"},
+		},
+		Path: "x.gsp",
+		Span: &JSONSpan{
+			Start: JSONPosition{Offset: 7, Line: 2, Column: 2},
+			End:   JSONPosition{Offset: 51, Line: 2, Column: 46},
+		},
+		Body: []JSONNode{{
+			Type:       "normal",
+			Name:       "p",
+			Attributes: []JSONAttribute{{"id", "b"}},
+			Children:   []JSONNode{{Type: "text", Text: "hi@x"}},
+		}},
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("request = %+v, want %+v", req, want)
+	}
+
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			input: "div { $json-para {} }",
+			want: `<div><p class="x">a &lt; b <b>c</b> C:\dir\ ` +
+				`a\@b</p></div>`,
+		},
+		{input: "$json-echo {}", wantErr: true},
+	}
+	for _, tt := range tests {
+		nodes, err := parser.Parse(strings.NewReader(tt.input), "x.gsp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		err = WriteAst(&out, "x.gsp", nodes, Options{
+			SearchPath: []string{"testdata/macros"},
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: WriteAst() error = %v, wantErr %v", tt.input,
+				err, tt.wantErr)
+		}
+		if got := out.String(); !tt.wantErr && got != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFromJSONNodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"Unknown type", `[{"type": "bogus", "name": "p"}]`},
+		{"Missing name", `[{"type": "normal"}]`},
+		{"Text with children", `[{"type": "text", "children": [{"type": "text"}]}]`},
+		{"Void with children", `[{"type": "void", "name": "br", "children": [{"type": "text"}]}]`},
+		{"Raw with elements", `[{"type": "raw", "name": "script", "children": [{"type": "void", "name": "br"}]}]`},
+		{"Trailing data", `[] []`},
+		{"Not an array", `{}`},
+		{"Comment without a node", `[{"type": "macro", "name": "x", "children": [{"type": "comment"}]}]`},
+		{"Comment with many nodes", `[{"type": "comment", "children": [{"type": "text"}, {"type": "text"}]}]`},
+		{"Invalid element name", `[{"type": "normal", "name": "p onclick=alert(1)"}]`},
+		{"Element name with a dollar", `[{"type": "normal", "name": "$p"}]`},
+		{"Invalid attribute name", `[{"type": "normal", "name": "p", "attributes": [{"name": "x><script>alert(2)</script", "value": ""}]}]`},
+		{"Empty attribute name", `[{"type": "normal", "name": "p", "attributes": [{"name": "", "value": ""}]}]`},
+		{"Macro name with a dollar", `[{"type": "macro", "name": "$x"}]`},
+		{"Invalid macro name", `[{"type": "verbatim-macro", "name": "x y"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readMacroResponse(strings.NewReader(tt.input)); err == nil {
+				t.Errorf("readMacroResponse() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestMacroServer(t *testing.T) {
+	servers := NewMacroServers()
+	opts := Options{
+		SearchPath: []string{"testdata/macros"},
+		Servers:    servers,
+	}
+
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "div { $server {} $server {} }", want: "<div><p>1</p><p>2</p></div>"},
+		{input: "$server fail {}", wantErr: true},
+		{input: "$server {}", want: "<p>4</p>"},
+	}
+	for _, tt := range tests {
+		nodes, err := parser.Parse(strings.NewReader(tt.input), "x.gsp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		err = WriteAst(&out, "x.gsp", nodes, opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: WriteAst() error = %v, wantErr %v", tt.input,
+				err, tt.wantErr)
+		}
+		if tt.wantErr && !strings.Contains(fmt.Sprint(err), "bad") {
+			t.Errorf("%s: WriteAst() error = %v, want the reported error",
+				tt.input, err)
+		}
+		if got := out.String(); !tt.wantErr && got != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+	if err := servers.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	/* Servers are private to each call by default */
+	opts.Servers = nil
+	for range 2 {
+		var out strings.Builder
+		nodes, _ := parser.Parse(strings.NewReader("$server {}"), "x.gsp")
+		if err := WriteAst(&out, "x.gsp", nodes, opts); err != nil {
+			t.Fatalf("WriteAst() error = %v", err)
+		}
+		if got := out.String(); got != "<p>1</p>" {
+			t.Errorf("output = %q, want %q", got, "<p>1</p>")
+		}
+	}
+
+	/* Killed servers are started again */
+	opts.Servers = NewMacroServers()
+	defer opts.Servers.Close()
+	opts.MacroTimeout = 100 * time.Millisecond
+	for _, input := range []string{"$server {}", "$server hang {}"} {
+		var out strings.Builder
+		nodes, _ := parser.Parse(strings.NewReader(input), "x.gsp")
+		err := WriteAst(&out, "x.gsp", nodes, opts)
+		if input == "$server hang {}" && !errors.As(err, new(MacroTimeoutError)) {
+			t.Errorf("%s: WriteAst() error = %v, want a MacroTimeoutError",
+				input, err)
+		}
+	}
+	var out strings.Builder
+	nodes, _ := parser.Parse(strings.NewReader("$server {}"), "x.gsp")
+	if err := WriteAst(&out, "x.gsp", nodes, opts); err != nil {
+		t.Fatalf("WriteAst() error = %v", err)
+	}
+	if got := out.String(); got != "<p>1</p>" {
+		t.Errorf("output = %q, want %q", got, "<p>1</p>")
+	}
+
+	/* Responses longer than permitted are rejected before being read */
+	opts.Servers = nil
+	for _, limit := range []int64{0, 1024} {
+		for _, input := range []string{"$server-huge {}",
+			"$server-huge error {}"} {
+			opts.MaxMacroOutput = limit
+			nodes, _ := parser.Parse(strings.NewReader(input), "x.gsp")
+			err := WriteAst(io.Discard, "x.gsp", nodes, opts)
+			if limit != 0 && input == "$server-huge {}" {
+				if !errors.As(err, new(MacroOutputError)) {
+					t.Errorf("%s: WriteAst() error = %v, want a "+
+						"MacroOutputError", input, err)
+				}
+			} else if !strings.Contains(fmt.Sprint(err),
+				"invalid response length") {
+				t.Errorf("%s: WriteAst() error = %v, want an invalid "+
+					"response length", input, err)
+			}
+		}
+	}
+}
+
+func TestMacroRecursion(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		depth int
+		want  MacroRecursionError
+	}{
+		{
+			name:  "Direct cycle",
+			input: "div { $loop {} }",
+			want:  MacroRecursionError{Chain: []string{"$loop", "$loop"}},
+		},
+		{
+			name:  "Indirect cycle",
+			input: "$ping {}",
+			want: MacroRecursionError{
+				Chain: []string{"$ping", "$pong", "$ping"},
+			},
+		},
+		{
+			name:  "Maximum depth",
+			input: "$grow {}",
+			depth: 3,
+			want: MacroRecursionError{
+				Chain: []string{"$grow", "$grow", "$grow", "$grow"},
+				Limit: 3,
+			},
+		},
+		{
+			name:  "Default maximum depth",
+			input: "$grow {}",
+			want: MacroRecursionError{
+				Chain: slices.Repeat([]string{"$grow"},
+					DefaultMaxMacroDepth+1),
+				Limit: DefaultMaxMacroDepth,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "x.gsp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = WriteAst(io.Discard, "x.gsp", nodes, Options{
+				SearchPath:    []string{"testdata/macros"},
+				MaxMacroDepth: tt.depth,
+			})
+
+			/* Reported once for the outermost invocation */
+			var merr MacroError
+			if !errors.As(err, &merr) {
+				t.Fatalf("WriteAst() error = %v, want a MacroError", err)
+			}
+			if !reflect.DeepEqual(merr.Err, tt.want) {
+				t.Errorf("WriteAst() error = %v, want %v", merr.Err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroErrorReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     string
+		wantName string /* The name of the macro that failed */
+		wantCode int
+		wantBt   int /* The length of the backtrace */
+	}{
+		{
+			name:     "Exit status",
+			input:    "p {}\n$fail {}",
+			want:     "x.gsp:2:0: macro ‘fail’: exit status 3",
+			wantName: "fail",
+			wantCode: 3,
+			wantBt:   1,
+		},
+		{
+			name:  "Within output",
+			input: "p {}\n$wrap-fail {}",
+			want: "x.gsp:2:0: macro ‘fail’: exit status 3\n" +
+				"\tin expansion of $fail at <output of $wrap-fail>:2:1\n" +
+				"\tin expansion of $wrap-fail at x.gsp:2:0",
+			wantName: "fail",
+			wantCode: 3,
+			wantBt:   2,
+		},
+		{
+			name:     "Invalid output",
+			input:    "$wrap-bad {}",
+			want:     "\tin expansion of $wrap-bad at x.gsp:1:0",
+			wantName: "bad-output",
+			wantCode: -1,
+			wantBt:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{0, 4} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, workers), func(t *testing.T) {
+				nodes, err := parser.Parse(strings.NewReader(tt.input), "x.gsp")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = WriteAst(io.Discard, "x.gsp", nodes, Options{
+					SearchPath:   []string{"testdata/macros"},
+					Stderr:       io.Discard,
+					MacroWorkers: workers,
+				})
+
+				var merr MacroError
+				if !errors.As(err, &merr) {
+					t.Fatalf("WriteAst() error = %v, want a MacroError", err)
+				}
+				if !strings.HasSuffix(err.Error(), tt.want) {
+					t.Errorf("WriteAst() error = %q, want suffix %q", err, tt.want)
+				}
+
+				bt := merr.Backtrace()
+				if len(bt) != tt.wantBt {
+					t.Fatalf("len(Backtrace()) = %d, want %d", len(bt), tt.wantBt)
+				}
+				got := bt[0]
+				if got.Name != tt.wantName || got.ExitCode != tt.wantCode {
+					t.Errorf("Backtrace()[0] = %s (exit %d), want %s (exit %d)",
+						got.Name, got.ExitCode, tt.wantName, tt.wantCode)
+				}
+				if want := "testdata/macros/" + tt.wantName; got.Executable != want {
+					t.Errorf("Executable = %q, want %q", got.Executable, want)
+				}
+				if tt.wantCode == 3 && got.Stderr != "oops\n" {
+					t.Errorf("Stderr = %q, want %q", got.Stderr, "oops\n")
+				}
+			})
+		}
+	}
+}
+
+func TestMacroErrorStderr(t *testing.T) {
+	for _, lines := range []int{10, 2000} {
+		var sb strings.Builder
+		for i := 1; i <= lines; i++ {
+			fmt.Fprintf(&sb, "line %d\n", i)
+		}
+		want := sb.String()
+		if len(want) > maxStderrTail {
+			want = want[len(want)-maxStderrTail:]
+			want = want[strings.IndexByte(want, '\n')+1:]
+		}
+
+		for _, workers := range []int{0, 4} {
+			t.Run(fmt.Sprintf("%d/%d", lines, workers), func(t *testing.T) {
+				input := fmt.Sprintf("$fail-loud lines=\"%d\" {}", lines)
+				nodes, err := parser.Parse(strings.NewReader(input), "x.gsp")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = WriteAst(io.Discard, "x.gsp", nodes, Options{
+					SearchPath:   []string{"testdata/macros"},
+					Stderr:       io.Discard,
+					MacroWorkers: workers,
+				})
+
+				var merr MacroError
+				if !errors.As(err, &merr) {
+					t.Fatalf("WriteAst() error = %v, want a MacroError", err)
+				}
+				if merr.Stderr != want {
+					got, _, _ := strings.Cut(merr.Stderr, "\n")
+					first, _, _ := strings.Cut(want, "\n")
+					t.Errorf("Stderr starts with %q and has %d bytes, "+
+						"want %q and %d bytes", got, len(merr.Stderr), first,
+						len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestMacroAttributeEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr string /* The colliding variable */
+	}{
+		{
+			name:  "No attributes",
+			input: "$$printenv {}",
+			want:  []string{"GSP_ATTRS=", "GSP_PATH=x.gsp", "GSP_TEXT_P=0"},
+		},
+		{
+			name:  "Multiple values",
+			input: `$$printenv .a data-x="1" .b {}`,
+			want: []string{
+				"GSP_ATTRS=class data-x",
+				"GSP_ATTR_CLASS=a b",
+				"GSP_ATTR_CLASS__N=2",
+				"GSP_ATTR_CLASS__1=a",
+				"GSP_ATTR_CLASS__2=b",
+				"GSP_ATTR_DATA_X=1",
+				"GSP_ATTR_DATA_X__N=1",
+				"GSP_ATTR_DATA_X__1=1",
+			},
+		},
+		{
+			name:  "Reserved names",
+			input: `$$printenv path="p" text-p="1" xml:lang="en" {}`,
+			want: []string{
+				"GSP_ATTRS=path text-p xml:lang",
+				"GSP_ATTR_PATH=p",
+				"GSP_ATTR_TEXT_P=1",
+				"GSP_ATTR_XML_LANG=en",
+				"GSP_PATH=x.gsp",
+				"GSP_TEXT_P=0",
+			},
+		},
+		{
+			name:    "Colliding names",
+			input:   `$$printenv data-x="1" data_x="2" {}`,
+			wantErr: "GSP_ATTR_DATA_X",
+		},
+		{
+			name:    "Colliding runs",
+			input:   `$$printenv data--x="1" data_-x="2" {}`,
+			wantErr: "GSP_ATTR_DATA_X",
+		},
+		{
+			name:  "Suffixed names",
+			input: `$$printenv x="a" x-n="b" x-1="c" {}`,
+			want: []string{
+				"GSP_ATTRS=x x-n x-1",
+				"GSP_ATTR_X=a",
+				"GSP_ATTR_X__N=1",
+				"GSP_ATTR_X__1=a",
+				"GSP_ATTR_X_N=b",
+				"GSP_ATTR_X_N__1=b",
+				"GSP_ATTR_X_1=c",
+				"GSP_ATTR_X_1__N=1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "x.gsp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			err = WriteAst(&out, "x.gsp", nodes, Options{
+				SearchPath: []string{"testdata/macros"},
+			})
+
+			var cerr AttributeCollisionError
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("WriteAst() error = %v", err)
+			case tt.wantErr != "" && !errors.As(err, &cerr):
+				t.Fatalf("WriteAst() error = %v, want an "+
+					"AttributeCollisionError", err)
+			case tt.wantErr != "" && cerr.Variable != tt.wantErr:
+				t.Errorf("Variable = %s, want %s", cerr.Variable, tt.wantErr)
+			}
+
+			var got []string
+			for _, l := range strings.Split(out.String(), "\n") {
+				if strings.HasPrefix(l, "GSP_") {
+					got = append(got, l)
+				}
+			}
+			for _, s := range tt.want {
+				if !slices.Contains(got, s) {
+					t.Errorf("environment lacks %q", s)
+				}
+			}
+		})
+	}
+}
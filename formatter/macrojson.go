@@ -0,0 +1,263 @@
+package formatter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+	g_strconv "git.thomasvoss.com/gsp/v4/strconv"
+)
+
+// JSONMarker is the string by which a macro opts in to the JSON
+// protocol.  A macro whose executable contains JSONMarker anywhere, such
+// as in a comment of a script, receives a MacroRequest on its standard
+// input instead of its body as GSP.  A regular macro using the JSON
+// protocol must write a JSON array of JSONNodes to its standard output,
+// which is formatted as if it were the parsed output of the macro.  The
+// output of verbatim macros is written as-is regardless of protocol.
+const JSONMarker = "gsp:json"
+
+// MacroRequestVersion is the version of the JSON protocol described by
+// MacroRequest.
+const MacroRequestVersion = 1
+
+// MacroRequest is the document written to the standard input of macros
+// using the JSON protocol.
+type MacroRequest struct {
+	// Version is MacroRequestVersion.
+	Version int `json:"version"`
+	// Name is the name of the macro without the leading ‘$’ or ‘$$’.
+	Name string `json:"name"`
+	// Verbatim specifies whether the macro is a verbatim macro.
+	Verbatim bool `json:"verbatim"`
+	// Attributes holds the attributes of the invocation in source
+	// order.  Attributes given more than once occur more than once.
+	Attributes []JSONAttribute `json:"attributes"`
+	// Path is the path of the document, as in GSP_PATH.
+	Path string `json:"path"`
+	// Span is the source range of the invocation, if known.
+	Span *JSONSpan `json:"span,omitempty"`
+	// Body holds the nodes of the body of the invocation.
+	Body []JSONNode `json:"body"`
+}
+
+// JSONNode is the JSON representation of an ast.Node.
+type JSONNode struct {
+	// Type is one of ‘normal’, ‘comment’, ‘void’, ‘escapable’, ‘raw’,
+	// ‘text’, ‘macro’, or ‘verbatim-macro’.
+	Type string `json:"type"`
+	// Name is the tag or macro name of nodes other than text nodes.
+	Name string `json:"name,omitempty"`
+	// Text is the content of text nodes.  It is literal text, without
+	// the escapes of GSP.
+	Text string `json:"text,omitempty"`
+	// Attributes holds the attributes of the node in source order.
+	Attributes []JSONAttribute `json:"attributes,omitempty"`
+	// Children holds the child nodes of the node.
+	Children []JSONNode `json:"children,omitempty"`
+	// Span is the source range of the node, if known.  It is ignored in
+	// the output of macros.
+	Span *JSONSpan `json:"span,omitempty"`
+}
+
+// JSONAttribute is the JSON representation of an ast.Attribute.
+type JSONAttribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// JSONSpan is the JSON representation of an ast.Span.
+type JSONSpan struct {
+	Start JSONPosition `json:"start"`
+	End   JSONPosition `json:"end"`
+}
+
+// JSONPosition is the JSON representation of an ast.Position.
+type JSONPosition struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Names of node types in JSONNode, indexed by ast.NodeType
+var jsonNodeTypes = [...]string{
+	ast.Normal:        "normal",
+	ast.Comment:       "comment",
+	ast.Void:          "void",
+	ast.Escapable:     "escapable",
+	ast.Raw:           "raw",
+	ast.Text:          "text",
+	ast.Macro:         "macro",
+	ast.VerbatimMacro: "verbatim-macro",
+}
+
+// writeMacroRequest writes the MacroRequest for the macro node in the
+// document at path to w.
+func writeMacroRequest(w io.Writer, path string, node ast.Node) error {
+	req := MacroRequest{
+		Version:    MacroRequestVersion,
+		Name:       node.Name,
+		Verbatim:   node.Type == ast.VerbatimMacro,
+		Attributes: toJSONAttributes(node.Attributes),
+		Path:       path,
+		Span:       toJSONSpan(node.Span),
+		Body:       toJSONNodes(node.Children, false),
+	}
+	if req.Attributes == nil {
+		req.Attributes = []JSONAttribute{}
+	}
+	if req.Body == nil {
+		req.Body = []JSONNode{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(req)
+}
+
+// readMacroResponse reads the JSON array of JSONNodes written by a macro
+// using the JSON protocol from r.
+func readMacroResponse(r io.Reader) ([]ast.Node, error) {
+	var jns []JSONNode
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&jns); err != nil {
+		return nil, fmt.Errorf("invalid JSON output: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON output: trailing data")
+	}
+	return fromJSONNodes(jns, false)
+}
+
+// toJSONNodes converts nodes into JSONNodes.  The text of nodes within
+// raw elements is not escaped, so raw specifies whether nodes are the
+// body of a raw element.
+func toJSONNodes(nodes []ast.Node, raw bool) []JSONNode {
+	var jns []JSONNode
+	for _, n := range nodes {
+		jn := JSONNode{
+			Type:       jsonNodeTypes[n.Type],
+			Attributes: toJSONAttributes(n.Attributes),
+			Children:   toJSONNodes(n.Children, n.Type == ast.Raw),
+			Span:       toJSONSpan(n.Span),
+		}
+		switch {
+		case n.Type == ast.Text && raw:
+			jn.Text = n.Name
+		case n.Type == ast.Text:
+			jn.Text = unescapeText(n.Name)
+		default:
+			jn.Name = n.Name
+		}
+		jns = append(jns, jn)
+	}
+	return jns
+}
+
+// fromJSONNodes converts the JSONNodes written by a macro into nodes,
+// validating them as the parser would.  As with toJSONNodes, raw
+// specifies whether the nodes are the body of a raw element.
+func fromJSONNodes(jns []JSONNode, raw bool) ([]ast.Node, error) {
+	var nodes []ast.Node
+	for _, jn := range jns {
+		i := 0
+		for i < len(jsonNodeTypes) && jsonNodeTypes[i] != jn.Type {
+			i++
+		}
+		if i == len(jsonNodeTypes) {
+			return nil, fmt.Errorf("invalid JSON output: invalid node type ‘%s’",
+				jn.Type)
+		}
+
+		n := ast.Node{Type: ast.NodeType(i), Name: jn.Name}
+		switch {
+		case n.Type == ast.Text:
+			n.Name = jn.Text
+			if !raw {
+				n.Name = g_strconv.EscapeText(jn.Text)
+			}
+			if jn.Name != "" || len(jn.Attributes) != 0 ||
+				len(jn.Children) != 0 {
+				return nil, errors.New("invalid JSON output: text nodes " +
+					"may only have text")
+			}
+		case n.Type == ast.Comment && len(jn.Children) != 1:
+			return nil, errors.New("invalid JSON output: comment nodes " +
+				"must have exactly one child node")
+		case n.Type != ast.Comment && n.Name == "":
+			return nil, fmt.Errorf("invalid JSON output: %s node without "+
+				"a name", jn.Type)
+		case n.Type == ast.Macro || n.Type == ast.VerbatimMacro:
+			if n.Name[0] == '$' || !parser.ValidName("$"+n.Name) {
+				return nil, fmt.Errorf("invalid JSON output: invalid "+
+					"macro name ‘%s’", n.Name)
+			}
+		case n.Type != ast.Comment && (n.Name[0] == '$' ||
+			!parser.ValidName(n.Name)):
+			return nil, fmt.Errorf("invalid JSON output: invalid "+
+				"element name ‘%s’", n.Name)
+		case n.Type == ast.Void && len(jn.Children) != 0:
+			return nil, fmt.Errorf("invalid JSON output: void element "+
+				"‘%s’ may not have any child nodes", n.Name)
+		case n.Type == ast.Raw || n.Type == ast.Escapable:
+			if len(jn.Children) > 1 ||
+				len(jn.Children) == 1 && jn.Children[0].Type != "text" {
+				return nil, fmt.Errorf("invalid JSON output: %s element "+
+					"‘%s’ may only contain text", jn.Type, n.Name)
+			}
+		}
+
+		for _, a := range jn.Attributes {
+			if !parser.ValidName(a.Name) {
+				return nil, fmt.Errorf("invalid JSON output: invalid "+
+					"attribute name ‘%s’", a.Name)
+			}
+			n.Attributes.Add(a.Name, a.Value)
+		}
+		children, err := fromJSONNodes(jn.Children, n.Type == ast.Raw)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = children
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func toJSONAttributes(as ast.Attributes) []JSONAttribute {
+	var jas []JSONAttribute
+	for _, a := range as {
+		jas = append(jas, JSONAttribute{a.Key, a.Value})
+	}
+	return jas
+}
+
+func toJSONSpan(span ast.Span) *JSONSpan {
+	if !span.Start.IsValid() {
+		return nil
+	}
+	return &JSONSpan{
+		Start: JSONPosition(span.Start),
+		End:   JSONPosition(span.End),
+	}
+}
+
+// unescapeText returns the GSP text s with its escapes removed.  A
+// trailing backslash, which may be left by recovering from an invalid
+// escape, is kept.
+func unescapeText(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,401 @@
+package formatter
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+	"github.com/tdewolff/parse/v2/js"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+// Attributes whose presence alone determines their value, and whose
+// values may thus be omitted when minifying
+var booleanAttributes = map[string]bool{
+	"allowfullscreen": true,
+	"async":           true,
+	"autofocus":       true,
+	"autoplay":        true,
+	"checked":         true,
+	"controls":        true,
+	"default":         true,
+	"defer":           true,
+	"disabled":        true,
+	"formnovalidate":  true,
+	"hidden":          true,
+	"inert":           true,
+	"ismap":           true,
+	"itemscope":       true,
+	"loop":            true,
+	"multiple":        true,
+	"muted":           true,
+	"nomodule":        true,
+	"novalidate":      true,
+	"open":            true,
+	"playsinline":     true,
+	"readonly":        true,
+	"required":        true,
+	"reversed":        true,
+	"selected":        true,
+}
+
+// Elements in which whitespace-only text is never rendered, and may
+// thus be removed when minifying
+var spacelessElements = map[string]bool{
+	"colgroup": true,
+	"datalist": true,
+	"dl":       true,
+	"head":     true,
+	"html":     true,
+	"menu":     true,
+	"ol":       true,
+	"optgroup": true,
+	"select":   true,
+	"table":    true,
+	"tbody":    true,
+	"tfoot":    true,
+	"thead":    true,
+	"tr":       true,
+	"ul":       true,
+}
+
+// Elements whose start tag closes an open p element
+var paragraphClosers = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"blockquote": true,
+	"details":    true,
+	"dialog":     true,
+	"div":        true,
+	"dl":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"header":     true,
+	"hgroup":     true,
+	"hr":         true,
+	"main":       true,
+	"menu":       true,
+	"nav":        true,
+	"ol":         true,
+	"p":          true,
+	"pre":        true,
+	"search":     true,
+	"section":    true,
+	"table":      true,
+	"ul":         true,
+}
+
+// followerKind represents what immediately follows an end tag.
+type followerKind int
+
+const (
+	followStart   followerKind = iota /* A start tag */
+	followText                        /* Text */
+	followComment                     /* A comment */
+	followEnd                         /* The end of the parent or document */
+	followOther                       /* Anything else, such as macro output */
+)
+
+type follower struct {
+	kind followerKind
+	name string /* Name of the element of a start tag */
+}
+
+// hasOptionalEnd reports whether the end tag of the element name may
+// be omitted in some contexts.
+func hasOptionalEnd(name string) bool {
+	switch name {
+	case "body", "caption", "colgroup", "dd", "dt", "head", "html", "li",
+		"optgroup", "option", "p", "rp", "rt", "tbody", "td", "tfoot",
+		"th", "thead", "tr":
+		return true
+	}
+	return false
+}
+
+// omitEnd reports whether the end tag of the element name whose parent
+// is the element parent may be omitted when followed by next, as given
+// by the rules for optional tags in the HTML standard.  Where the
+// standard permits omission before whitespace or text but doing so
+// could move the text into the element, the end tag is kept.
+func omitEnd(name, parent string, next follower) bool {
+	start := func(names ...string) bool {
+		if next.kind != followStart {
+			return false
+		}
+		for _, n := range names {
+			if n == next.name {
+				return true
+			}
+		}
+		return false
+	}
+	end := next.kind == followEnd
+
+	switch name {
+	case "html", "body":
+		return next.kind != followComment && next.kind != followOther
+	case "head", "caption", "colgroup":
+		return next.kind == followStart || end
+	case "li":
+		return start("li") || end
+	case "dt":
+		return start("dt", "dd")
+	case "dd":
+		return start("dd", "dt") || end
+	case "p":
+		if next.kind == followStart {
+			return paragraphClosers[next.name]
+		}
+		switch parent {
+		case "a", "audio", "del", "ins", "map", "noscript", "video":
+			return false
+		}
+		return end && !strings.Contains(parent, "-")
+	case "rt", "rp":
+		return start("rt", "rp") || end
+	case "optgroup":
+		return start("optgroup", "hr") || end
+	case "option":
+		return start("option", "optgroup", "hr") || end
+	case "thead":
+		return start("tbody", "tfoot")
+	case "tbody":
+		return start("tbody", "tfoot") || end
+	case "tfoot":
+		return end
+	case "tr":
+		return start("tr") || end
+	case "td", "th":
+		return start("td", "th") || end
+	}
+	return false
+}
+
+// isHTMLSpace reports whether b is ASCII whitespace as defined by the
+// HTML standard.
+func isHTMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\f' || b == '\r'
+}
+
+// collapseSpace replaces each run of ASCII whitespace in s with a
+// single space.
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if !isHTMLSpace(s[i]) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		sb.WriteByte(' ')
+		for i+1 < len(s) && isHTMLSpace(s[i+1]) {
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// unquotable reports whether the escaped attribute value v may be
+// written without quotes.
+func unquotable(v string) bool {
+	return v != "" && !strings.ContainsAny(v, " \t\n\f\r\"'=<>`")
+}
+
+// minifyRaw returns the body s of the Raw node minified according to
+// its language, or s as-is if the language is unknown or s could not
+// be lexed.
+func minifyRaw(node ast.Node, s string) string {
+	ty, _ := node.Attributes.Get("type")
+	switch ty = parser.MediaType(ty); {
+	case node.Name == "style" && (ty == "" || ty == "text/css"):
+		if bs, ok := minifyCSS([]byte(s)); ok {
+			return string(bs)
+		}
+	case node.Name == "script" && scriptTypes[ty]:
+		if bs, ok := minifyJS([]byte(s)); ok {
+			return string(bs)
+		}
+	}
+	return s
+}
+
+// Values of the type attribute of scripts containing JavaScript or JSON
+var scriptTypes = map[string]bool{
+	"":                       true,
+	"application/javascript": true,
+	"application/json":       true,
+	"application/ld+json":    true,
+	"importmap":              true,
+	"module":                 true,
+	"text/javascript":        true,
+}
+
+// Values of the type attribute of scripts containing JSON
+var jsonTypes = map[string]bool{
+	"application/json":    true,
+	"application/ld+json": true,
+	"importmap":           true,
+}
+
+// minifyCSS removes comments and insignificant whitespace from the CSS
+// source bs.  It reports false if bs could not be lexed.
+func minifyCSS(bs []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(bs))
+	l := css.NewLexer(parse.NewInputBytes(bs))
+
+	/* Whether whitespace or a comment precedes the next token */
+	var space, comment bool
+	prev := css.LeftBraceToken
+
+	for {
+		tt, data := l.Next()
+		switch tt {
+		case css.ErrorToken:
+			return out, l.Err() == io.EOF
+		case css.WhitespaceToken:
+			space = true
+			continue
+		case css.CommentToken:
+			comment = true
+			continue
+		}
+
+		switch {
+		case space && !cssTightAfter(prev, out) && !cssTightBefore(tt, data):
+			out = append(out, ' ')
+		case (space || comment) && len(out) != 0 &&
+			isCSSWord(out[len(out)-1]) && isCSSWord(data[0]):
+			/* Comments are not whitespace, but separate tokens that
+			   would otherwise be merged */
+			out = append(out, "/**/"...)
+		}
+		out = append(out, data...)
+		space, comment, prev = false, false, tt
+	}
+}
+
+// cssTightAfter reports whether whitespace following the token of type
+// tt ending out is insignificant.
+func cssTightAfter(tt css.TokenType, out []byte) bool {
+	switch tt {
+	case css.LeftBraceToken, css.RightBraceToken, css.SemicolonToken,
+		css.CommaToken, css.ColonToken, css.LeftParenthesisToken:
+		return true
+	case css.DelimToken:
+		return out[len(out)-1] == '>'
+	}
+	return false
+}
+
+// cssTightBefore reports whether whitespace preceding the token data
+// of type tt is insignificant.
+func cssTightBefore(tt css.TokenType, data []byte) bool {
+	switch tt {
+	case css.LeftBraceToken, css.RightBraceToken, css.SemicolonToken,
+		css.CommaToken, css.RightParenthesisToken:
+		return true
+	case css.DelimToken:
+		return data[0] == '>' || data[0] == '!'
+	}
+	return false
+}
+
+func isCSSWord(b byte) bool {
+	return isJSWord(b) && b != '$' || b == '-' || b == '.' || b == '%'
+}
+
+// minifyJS removes comments and insignificant whitespace from the
+// JavaScript source bs.  Line breaks are kept where automatic
+// semicolon insertion may depend on them.  It reports false if bs
+// could not be lexed.
+func minifyJS(bs []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(bs))
+	l := js.NewLexer(parse.NewInputBytes(bs))
+
+	/* Whether whitespace or a line break precedes the next token */
+	var space, newline bool
+	prev := js.SemicolonToken
+
+	for {
+		tt, data := l.Next()
+		switch tt {
+		case js.ErrorToken:
+			return out, l.Err() == io.EOF
+		case js.WhitespaceToken, js.CommentToken:
+			space = true
+			continue
+		case js.LineTerminatorToken, js.CommentLineTerminatorToken:
+			newline = true
+			continue
+		case js.DivToken, js.DivEqToken:
+			if jsRegExpAllowed(prev) {
+				if tt, data = l.RegExp(); tt == js.ErrorToken {
+					return out, false
+				}
+			}
+		}
+
+		switch {
+		case len(out) == 0:
+		case newline && prev != js.SemicolonToken &&
+			prev != js.OpenBraceToken && prev != js.CommaToken &&
+			tt != js.CloseBraceToken:
+			out = append(out, '\n')
+		case (space || newline) && jsSeparate(prev, out[len(out)-1], data[0]):
+			out = append(out, ' ')
+		}
+		out = append(out, data...)
+		space, newline, prev = false, false, tt
+	}
+}
+
+// jsRegExpAllowed reports whether a slash following a token of type tt
+// begins a regular expression rather than being a division.
+func jsRegExpAllowed(tt js.TokenType) bool {
+	switch tt {
+	case js.StringToken, js.TemplateToken, js.TemplateEndToken,
+		js.RegExpToken, js.PrivateIdentifierToken, js.CloseParenToken,
+		js.CloseBracketToken, js.CloseBraceToken, js.IncrToken,
+		js.DecrToken, js.ThisToken, js.SuperToken, js.NullToken,
+		js.TrueToken, js.FalseToken:
+		return false
+	}
+	return !js.IsIdentifier(tt) && !js.IsNumeric(tt)
+}
+
+// jsSeparate reports whether a token of type tt ending with the byte a
+// must be separated from a following token starting with the byte b.
+func jsSeparate(tt js.TokenType, a, b byte) bool {
+	switch {
+	case isJSWord(a) && isJSWord(b):
+	case (a == '+' || a == '-') && a == b:
+	case a == '/' && (b == '/' || b == '*'):
+	case a == '<' && (b == '!' || b == '/'):
+	case a == '-' && b == '>':
+	case js.IsNumeric(tt) && b == '.':
+	case tt == js.RegExpToken && isJSWord(b):
+	default:
+		return false
+	}
+	return true
+}
+
+func isJSWord(b byte) bool {
+	return b >= utf8.RuneSelf || b == '_' || b == '$' || b == '\\' ||
+		b == '#' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') ||
+		(b >= 'A' && b <= 'Z')
+}
@@ -0,0 +1,336 @@
+package formatter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// Elements which are laid out on their own lines when pretty-printing.
+// Whitespace surrounding these elements does not affect rendering.
+var blockElements = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"base":       true,
+	"blockquote": true,
+	"body":       true,
+	"caption":    true,
+	"col":        true,
+	"colgroup":   true,
+	"dd":         true,
+	"details":    true,
+	"dialog":     true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"head":       true,
+	"header":     true,
+	"hgroup":     true,
+	"hr":         true,
+	"html":       true,
+	"li":         true,
+	"link":       true,
+	"main":       true,
+	"menu":       true,
+	"meta":       true,
+	"nav":        true,
+	"ol":         true,
+	"p":          true,
+	"pre":        true,
+	"section":    true,
+	"style":      true,
+	"summary":    true,
+	"table":      true,
+	"tbody":      true,
+	"td":         true,
+	"tfoot":      true,
+	"th":         true,
+	"thead":      true,
+	"title":      true,
+	"tr":         true,
+	"ul":         true,
+}
+
+// Elements whose contents are left untouched when pretty-printing, as
+// whitespace within them is significant
+var preformattedElements = map[string]bool{
+	"pre":      true,
+	"textarea": true,
+}
+
+// printer is the destination of the HTML formatter.  When
+// pretty-printing it inserts newlines and indentation around
+// block-level elements, and when minifying it omits optional end tags.
+// Otherwise output is written as-is.
+type printer struct {
+	w         io.Writer
+	indent    string
+	minify    bool
+	minifyRaw bool
+	xml       bool
+	started   bool /* Anything has been written */
+	last      byte /* The last byte written */
+	comments  int  /* Number of open comments */
+
+	/* Elements whose open tag has been written but not their close
+	   tag */
+	open   []openElement
+	depth  int /* Number of open block-level elements */
+	frozen int /* Number of open preformatted elements */
+
+	/* An end tag that is only written once what follows it is known,
+	   as it may be omitted */
+	pending       string
+	pendingParent string
+	pendingSpan   ast.Span
+
+	/* The source map being built, the path of the source file, and the
+	   position of the end of the output */
+	sm   *SourceMap
+	path string
+	pos  ast.Position
+	cr   bool /* The last byte written was a carriage return */
+
+	/* Macros being expanded, outermost first, whose output is not
+	   mapped */
+	expansions []expansion
+
+	/* Runs macros concurrently, if enabled */
+	runner *macroRunner
+}
+
+type openElement struct {
+	name      string
+	block     bool
+	hasBlocks bool /* A block-level element is a child */
+	mapping   int  /* Index of the mapping of the open tag, or -1 */
+}
+
+func newPrinter(w io.Writer, path string, opts Options) *printer {
+	p := &printer{
+		w:         w,
+		indent:    opts.Indent,
+		minify:    opts.Minify,
+		minifyRaw: opts.MinifyRaw,
+		xml:       opts.XML,
+		sm:        opts.SourceMap,
+		path:      path,
+		pos:       ast.Position{Line: 1, Column: 1},
+	}
+	if p.minify {
+		p.indent = ""
+	}
+	return p
+}
+
+// Write writes bs as-is, after any pending end tag.  Within comments
+// in XML documents, hyphens are separated by spaces as double hyphens
+// are not permitted.
+func (p *printer) Write(bs []byte) (int, error) {
+	if err := p.resolve(follower{kind: followOther}); err != nil {
+		return 0, err
+	}
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	p.started = true
+
+	if p.xml && p.comments != 0 {
+		for i, b := range bs {
+			if b == '-' && p.last == '-' {
+				if _, err := p.w.Write([]byte{' '}); err != nil {
+					return i, err
+				}
+			}
+			if _, err := p.w.Write([]byte{b}); err != nil {
+				return i, err
+			}
+			p.last = b
+			p.advance([]byte{b})
+		}
+		return len(bs), nil
+	}
+
+	p.last = bs[len(bs)-1]
+	n, err := p.w.Write(bs)
+	p.advance(bs[:n])
+	return n, err
+}
+
+// advance moves the output position past bs.  Line feeds, carriage
+// returns, and carriage return–line feed pairs each end a line.
+func (p *printer) advance(bs []byte) {
+	if p.sm == nil {
+		return
+	}
+	for len(bs) > 0 {
+		r, n := utf8.DecodeRune(bs)
+		switch {
+		case r == '\n' && p.cr:
+		case r == '\r', r == '\n':
+			p.pos.Line++
+			p.pos.Column = 0
+			fallthrough
+		default:
+			p.pos.Column++
+		}
+		p.cr = r == '\r'
+		p.pos.Offset += n
+		bs = bs[n:]
+	}
+}
+
+// record adds a mapping of the given kind from the output written since
+// start to the source span.  It returns the index of the mapping, or -1
+// if none was added.
+func (p *printer) record(kind MappingKind, span ast.Span, start ast.Position) int {
+	if p.sm == nil || len(p.expansions) != 0 || !span.Start.IsValid() {
+		return -1
+	}
+	p.sm.Mappings = append(p.sm.Mappings, Mapping{
+		Kind:   kind,
+		Output: ast.Span{Start: start, End: p.pos},
+		Path:   p.path,
+		Source: span,
+	})
+	return len(p.sm.Mappings) - 1
+}
+
+// parent returns the name of the innermost open element, or the empty
+// string if there is none.
+func (p *printer) parent() string {
+	if len(p.open) == 0 {
+		return ""
+	}
+	return p.open[len(p.open)-1].name
+}
+
+// isBlock reports whether the element name is laid out on its own line
+// when opened within the currently open elements.
+func (p *printer) isBlock(name string) bool {
+	if p.indent == "" || p.frozen != 0 {
+		return false
+	}
+	if name == "script" && len(p.open) != 0 {
+		/* Scripts are only safe to move within the document head */
+		return p.parent() == "head"
+	}
+	return blockElements[name]
+}
+
+// beginElement must be called before writing the open tag of node.
+func (p *printer) beginElement(node ast.Node) error {
+	if err := p.resolve(follower{followStart, node.Name}); err != nil {
+		return err
+	}
+
+	block := p.isBlock(node.Name)
+	if block {
+		if len(p.open) != 0 {
+			p.open[len(p.open)-1].hasBlocks = true
+		}
+		if err := p.newline(); err != nil {
+			return err
+		}
+	}
+
+	if node.Type != ast.Void {
+		p.open = append(p.open, openElement{
+			name:    node.Name,
+			block:   block,
+			mapping: -1,
+		})
+		if block {
+			p.depth++
+		}
+		if preformattedElements[node.Name] {
+			p.frozen++
+		}
+	}
+	return nil
+}
+
+// endElement must be called before writing the close tag of node.  It
+// reports whether the close tag should be written, as when minifying
+// it may instead become pending.
+func (p *printer) endElement(node ast.Node) (bool, error) {
+	if err := p.resolve(follower{kind: followEnd}); err != nil {
+		return false, err
+	}
+	if len(p.open) == 0 {
+		return true, nil
+	}
+
+	e := p.open[len(p.open)-1]
+	p.open = p.open[:len(p.open)-1]
+	if e.mapping != -1 {
+		/* When streaming, the span of the node is only known once it
+		   has ended */
+		p.sm.Mappings[e.mapping].Source = node.Span
+	}
+	if preformattedElements[e.name] {
+		p.frozen--
+	}
+	if e.block {
+		p.depth--
+		if e.hasBlocks {
+			if err := p.newline(); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if p.minify && !p.xml && hasOptionalEnd(node.Name) {
+		p.pending, p.pendingParent = node.Name, p.parent()
+		p.pendingSpan = node.Span
+		return false, nil
+	}
+	return true, nil
+}
+
+// resolve writes the pending end tag, if any, unless it may be omitted
+// when followed by next.
+func (p *printer) resolve(next follower) error {
+	if p.pending == "" {
+		return nil
+	}
+	name := p.pending
+	p.pending = ""
+	if omitEnd(name, p.pendingParent, next) {
+		return nil
+	}
+	start := p.pos
+	_, err := fmt.Fprintf(p, "</%s>", name)
+	p.record(MappingTag, p.pendingSpan, start)
+	return err
+}
+
+// finish must be called once the whole document has been written.
+func (p *printer) finish() error {
+	return p.resolve(follower{kind: followEnd})
+}
+
+// newline starts a new line indented to the current depth, unless
+// nothing has been written yet.
+func (p *printer) newline() error {
+	if !p.started {
+		return nil
+	}
+	_, err := io.WriteString(p, "\n"+strings.Repeat(p.indent, p.depth))
+	return err
+}
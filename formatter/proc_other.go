@@ -0,0 +1,12 @@
+//go:build !unix
+
+package formatter
+
+import "os/exec"
+
+func setupProcess(cmd *exec.Cmd) {}
+
+// killProcess kills the started macro cmd.
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
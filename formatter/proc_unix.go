@@ -0,0 +1,22 @@
+//go:build unix
+
+package formatter
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setupProcess places the macro cmd in its own process group, such that
+// killing it also kills any processes it started.  Otherwise a killed
+// macro whose children hold its standard output open would block the
+// formatter until they exit.
+func setupProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return killProcess(cmd) }
+}
+
+// killProcess kills the started macro cmd and its process group.
+func killProcess(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
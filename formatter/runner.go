@@ -0,0 +1,280 @@
+package formatter
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+// The maximum number of events read ahead of the macro being awaited
+// when formatting a stream
+const maxReadAhead = 1 << 16
+
+// macroRunner starts macros ahead of the point at which their output is
+// written, such that up to a fixed number of macros are run at once.
+// Macros are started and awaited in source order.
+type macroRunner struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	path    string
+	opts    Options
+	workers int
+
+	todo    []ast.Node  /* Macros yet to be started */
+	pending []*macroJob /* Macros started but not yet awaited */
+}
+
+// macroJob is a single macro run by a macroRunner.  Its output is held
+// in memory until it is written.
+type macroJob struct {
+	node   ast.Node
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	exe    string     /* The path of the executable, if found */
+	out    []byte     /* The output of a verbatim macro */
+	nodes  []ast.Node /* The parsed output of a regular macro */
+	stderr bytes.Buffer
+	err    error
+}
+
+// newMacroRunner returns a runner for the macros of the document at
+// path, or nil if opts does not permit running macros concurrently.
+func newMacroRunner(ctx context.Context, path string,
+	opts Options) *macroRunner {
+	if opts.MacroWorkers < 2 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &macroRunner{
+		ctx:     ctx,
+		cancel:  cancel,
+		path:    path,
+		opts:    opts,
+		workers: opts.MacroWorkers,
+	}
+}
+
+// full reports whether no more macros may be started.
+func (r *macroRunner) full() bool {
+	return len(r.pending) >= r.workers
+}
+
+// start starts the macro node.
+func (r *macroRunner) start(node ast.Node) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	j := &macroJob{node: node, cancel: cancel, done: make(chan struct{})}
+	r.pending = append(r.pending, j)
+
+	go func() {
+		defer close(j.done)
+		defer cancel()
+
+		exe, err := loadMacro(node.Name, r.opts.SearchPath)
+		if err != nil {
+			j.err = err
+			return
+		}
+		j.exe = exe.path
+		j.err = execMacro(ctx, exe, r.path, node, r.opts, &j.stderr,
+			func(rd io.Reader) error {
+				var err error
+				if node.Type == ast.VerbatimMacro {
+					j.out, err = io.ReadAll(rd)
+				} else {
+					j.nodes, err = parseMacroOutput(ctx, rd, exe, node)
+				}
+				return err
+			})
+	}()
+}
+
+// take waits for the earliest started macro to finish and returns it.
+func (r *macroRunner) take() *macroJob {
+	r.fill()
+	j := r.pending[0]
+	r.pending = r.pending[1:]
+	r.fill()
+	<-j.done
+	return j
+}
+
+// fill starts macros yet to be started until the runner is full.
+func (r *macroRunner) fill() {
+	for !r.full() && len(r.todo) != 0 {
+		r.start(r.todo[0])
+		r.todo = r.todo[1:]
+	}
+}
+
+// discard kills the earliest started macro, as its output is not
+// written.
+func (r *macroRunner) discard() {
+	j := r.pending[0]
+	r.pending = r.pending[1:]
+	j.cancel()
+	<-j.done
+}
+
+// close kills all running macros and waits for them to exit.
+func (r *macroRunner) close() {
+	r.cancel()
+	for _, j := range r.pending {
+		<-j.done
+	}
+	r.pending = nil
+}
+
+// write writes the output of the finished macro j to w, after its
+// standard error.
+func (j *macroJob) write(ctx context.Context, w *printer, path string,
+	opts Options) error {
+	tail := stderrTail(j.stderr.Bytes())
+	if _, err := j.stderr.WriteTo(stderrOf(opts)); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case j.err != nil:
+		err = j.err
+	case j.node.Type == ast.VerbatimMacro:
+		_, err = w.Write(j.out)
+	default:
+		err = writeNodes(ctx, w, path, j.nodes, opts)
+	}
+	if err != nil && j.exe != "" {
+		return macroFailure{j.exe, tail, err}
+	}
+	return err
+}
+
+// collectMacros appends the macros within nodes to dst in the order in
+// which writeNodes expands them.
+func collectMacros(dst, nodes []ast.Node, opts Options) []ast.Node {
+	for _, n := range nodes {
+		switch n.Type {
+		case ast.Macro, ast.VerbatimMacro:
+			dst = append(dst, n)
+		case ast.Comment:
+			if opts.Comments {
+				dst = collectMacros(dst, n.Children, opts)
+			}
+		case ast.Normal, ast.Escapable:
+			dst = collectMacros(dst, n.Children, opts)
+		}
+	}
+	return dst
+}
+
+// eventSource provides the events of a decoder to WriteStream.  When
+// macros are run concurrently it reads ahead of the macro being awaited
+// to start the macros that follow it.
+type eventSource struct {
+	dec    *parser.Decoder
+	runner *macroRunner
+	queue  []streamItem
+	err    error /* The error that ended reading ahead */
+	strict bool  /* Stop once the decoder recovered from an error */
+}
+
+// streamItem is an event read by an eventSource.  If the event starts a
+// macro that was started ahead of time, node is the macro node.
+type streamItem struct {
+	ev   parser.Event
+	node *ast.Node
+}
+
+func (s *eventSource) next() (streamItem, error) {
+	if len(s.queue) != 0 {
+		it := s.queue[0]
+		s.queue = s.queue[1:]
+		return it, s.check()
+	}
+	if s.err != nil {
+		return streamItem{}, s.err
+	}
+	ev, err := s.dec.Next()
+	if err != nil {
+		return streamItem{}, err
+	}
+	return streamItem{ev: ev}, s.check()
+}
+
+// readNode reads the remainder of the macro started by it.
+func (s *eventSource) readNode(it streamItem) (ast.Node, error) {
+	if it.node != nil {
+		return *it.node, nil
+	}
+	node, err := s.dec.ReadNode(it.ev)
+	if err != nil {
+		return node, err
+	}
+	return node, s.check()
+}
+
+// check returns the errors the decoder recovered from if formatting
+// should stop because of them.
+func (s *eventSource) check() error {
+	if !s.strict {
+		return nil
+	}
+	return s.dec.Err()
+}
+
+// readAhead reads events until the runner is full, starting the macros
+// it reads.
+func (s *eventSource) readAhead() {
+	for s.err == nil && !s.runner.full() && len(s.queue) < maxReadAhead {
+		ev, err := s.dec.Next()
+		if err == nil {
+			err = s.check()
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+		it := streamItem{ev: ev}
+		if isMacroStart(ev) {
+			node, err := s.dec.ReadNode(ev)
+			if err == nil {
+				err = s.check()
+			}
+			if err != nil {
+				s.err = err
+				return
+			}
+			s.runner.start(node)
+			it.node = &node
+		}
+		s.queue = append(s.queue, it)
+	}
+}
+
+// skip discards the items of the remainder of the most recently
+// started node.
+func (s *eventSource) skip() error {
+	for depth := 1; depth > 0; {
+		it, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case it.node != nil:
+			s.runner.discard()
+		case it.ev.Kind == parser.StartNode, it.ev.Kind == parser.Comment:
+			depth++
+		case it.ev.Kind == parser.EndNode:
+			depth--
+		}
+	}
+	return nil
+}
+
+func isMacroStart(ev parser.Event) bool {
+	return ev.Kind == parser.StartNode &&
+		(ev.Type == ast.Macro || ev.Type == ast.VerbatimMacro)
+}
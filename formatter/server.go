@@ -0,0 +1,344 @@
+package formatter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// ServerMarker is the string by which a macro opts in to being run as
+// a server.  A macro whose executable contains ServerMarker anywhere,
+// such as in a comment of a script, is started once and then sent a
+// framed request for each invocation, instead of being run once per
+// invocation.
+//
+// Each request is a MacroRequest encoded as JSON, preceded by its
+// length in bytes in decimal and a newline.  The server answers each
+// request in turn with its output preceded by its length and a newline,
+// or with a message preceded by ‘error’, a space, its length, and a
+// newline if the invocation failed.  The output is interpreted as the
+// output of a one-shot macro would be, and so is a JSON array of
+// JSONNodes if the macro also contains JSONMarker.  Once no more
+// requests are sent, the standard input of the server is closed and it
+// should exit.
+const ServerMarker = "gsp:server"
+
+// The duration for which a server may run after its standard input is
+// closed before it is killed
+const serverGracePeriod = 5 * time.Second
+
+// The maximum length of a response of a server when Options.MaxMacroOutput
+// does not set a lower one
+const maxServerResponse = 1 << 30
+
+// MacroServers manages the running servers of macros that opted in with
+// ServerMarker.  Each server is started when first needed, and is sent
+// one request at a time.  A server that fails other than by reporting
+// an error, such as by exiting or exceeding a limit, is killed and
+// started again for the next request.
+//
+// The environment and limits of a server are those of the Options of
+// the invocation that started it.  MacroTimeout and MaxMacroOutput
+// apply to each request, whereas MacroCPULimit and MacroMemoryLimit
+// apply to the whole lifetime of the server.
+//
+// A MacroServers may be used by multiple goroutines.
+type MacroServers struct {
+	mu      sync.Mutex
+	servers map[string]*macroServer /* Keyed by executable path */
+	closed  bool
+}
+
+// NewMacroServers returns an empty set of macro servers.
+func NewMacroServers() *MacroServers {
+	return &MacroServers{servers: make(map[string]*macroServer)}
+}
+
+// Close shuts down all running servers, waiting for them to exit.
+// Servers that do not exit within a grace period are killed.  Close
+// returns an error if any server did not exit successfully.
+func (s *MacroServers) Close() error {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		/* Wait for any request in progress */
+		srv.mu.Lock()
+		if err := srv.shutdown(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", srv.exe.path, err))
+		}
+		srv.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// macroServer is a running server of a macro.
+type macroServer struct {
+	mu     sync.Mutex /* Held for the duration of a request */
+	exe    macroExecutable
+	opts   Options
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr stderrSwitch
+	dead   bool /* The server was killed or exited */
+}
+
+// get returns the server of exe, starting it if it is not running.
+func (s *MacroServers) get(exe macroExecutable,
+	opts Options) (*macroServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("macro servers closed")
+	}
+
+	/* A server whose executable changed is replaced */
+	if srv, ok := s.servers[exe.path]; ok && srv.exe.sum == exe.sum {
+		return srv, nil
+	} else if ok {
+		go func() {
+			srv.mu.Lock()
+			srv.shutdown()
+			srv.mu.Unlock()
+		}()
+	}
+
+	srv, err := startServer(exe, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.servers[exe.path] = srv
+	return srv, nil
+}
+
+// remove removes the dead server srv, if it is still registered.
+func (s *MacroServers) remove(srv *macroServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers[srv.exe.path] == srv {
+		delete(s.servers, srv.exe.path)
+	}
+}
+
+func startServer(exe macroExecutable, opts Options) (*macroServer, error) {
+	if opts.MacroCPULimit > 0 || opts.MacroMemoryLimit > 0 {
+		if err := checkLimits(); err != nil {
+			return nil, err
+		}
+	}
+
+	srv := &macroServer{exe: exe, opts: opts}
+	srv.stderr.w = stderrOf(opts)
+
+	/* Not tied to the context of the request starting it, as the server
+	   outlives it */
+	cmd := exec.CommandContext(context.Background(), exe.path)
+	cmd.Env = macroEnv(opts)
+	cmd.Stderr = &srv.stderr
+	setupProcess(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err = setLimits(cmd.Process.Pid, opts); err != nil {
+		killProcess(cmd)
+		cmd.Wait()
+		return nil, err
+	}
+
+	srv.cmd = cmd
+	srv.stdin = stdin
+	srv.stdout = bufio.NewReader(stdout)
+	return srv, nil
+}
+
+// run runs the server macro exe for node as runMacro does.
+func (s *MacroServers) run(ctx context.Context, exe macroExecutable,
+	fpath string, node ast.Node, opts Options, stderr io.Writer,
+	consume func(io.Reader) error) error {
+	var srv *macroServer
+	for {
+		var err error
+		if srv, err = s.get(exe, opts); err != nil {
+			return err
+		}
+		srv.mu.Lock()
+		if !srv.dead {
+			break
+		}
+		/* Killed by another request while we waited */
+		srv.mu.Unlock()
+	}
+
+	out, err := srv.request(ctx, fpath, node, opts, stderr)
+	if srv.dead {
+		s.remove(srv)
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	/* The server is released first, as the output may itself invoke
+	   the macro */
+	return consume(bytes.NewReader(out))
+}
+
+// request sends the request for the macro node to srv and returns the
+// output of the macro.  If the server cannot be used for further
+// requests, it is killed.
+func (srv *macroServer) request(ctx context.Context, fpath string,
+	node ast.Node, opts Options, stderr io.Writer) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	srv.stderr.set(stderr)
+	defer srv.stderr.set(stderrOf(opts))
+
+	parent := ctx
+	if opts.MacroTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.MacroTimeout,
+			MacroTimeoutError{opts.MacroTimeout})
+		defer cancel()
+	}
+
+	/* Killing the server unblocks any pending read or write */
+	stop := context.AfterFunc(ctx, func() { killProcess(srv.cmd) })
+	out, err := srv.exchange(fpath, node, opts)
+	if !stop() {
+		srv.wait()
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		return nil, context.Cause(ctx)
+	}
+	return out, err
+}
+
+// exchange writes a request to srv and reads its response.
+func (srv *macroServer) exchange(fpath string, node ast.Node,
+	opts Options) ([]byte, error) {
+	var req bytes.Buffer
+	if err := writeMacroRequest(&req, fpath, node); err != nil {
+		return nil, err
+	}
+	frame := append(strconv.AppendInt(nil, int64(req.Len()), 10), '\n')
+	frame = append(frame, req.Bytes()...)
+	if _, err := srv.stdin.Write(frame); err != nil {
+		return nil, srv.fail(err)
+	}
+
+	header, err := srv.stdout.ReadString('\n')
+	if err != nil {
+		return nil, srv.fail(err)
+	}
+	header = strings.TrimSuffix(header, "\n")
+	size, failed := strings.CutPrefix(header, "error ")
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return nil, srv.fail(fmt.Errorf("invalid response header ‘%s’",
+			header))
+	}
+	limited := opts.MaxMacroOutput > 0 && opts.MaxMacroOutput < maxServerResponse
+	switch {
+	case !failed && limited && n > opts.MaxMacroOutput:
+		killProcess(srv.cmd)
+		srv.wait()
+		return nil, MacroOutputError{opts.MaxMacroOutput}
+	case limited && n > opts.MaxMacroOutput, n > maxServerResponse:
+		return nil, srv.fail(fmt.Errorf("invalid response length %d", n))
+	}
+
+	/* Read rather than allocated up front, as the server may exit
+	   before writing all that it announced */
+	var out bytes.Buffer
+	if _, err := io.CopyN(&out, srv.stdout, n); err != nil {
+		return nil, srv.fail(err)
+	}
+	if failed {
+		return nil, errors.New(strings.TrimSpace(out.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// fail kills srv after the request failed with err, and returns the
+// error to report.
+func (srv *macroServer) fail(err error) error {
+	killProcess(srv.cmd)
+	if werr := srv.wait(); werr != nil {
+		if lerr := limitError(srv.cmd.ProcessState, srv.opts); lerr != nil {
+			return lerr
+		}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("macro server exited unexpectedly")
+	}
+	return fmt.Errorf("macro server failed: %w", err)
+}
+
+// wait waits for the killed or exiting server srv to exit.
+func (srv *macroServer) wait() error {
+	if srv.dead {
+		return nil
+	}
+	srv.dead = true
+	return srv.cmd.Wait()
+}
+
+// shutdown closes the standard input of srv and waits for it to exit,
+// killing it after a grace period.
+func (srv *macroServer) shutdown() error {
+	if srv.dead {
+		return nil
+	}
+	srv.stdin.Close()
+	timer := time.AfterFunc(serverGracePeriod, func() {
+		killProcess(srv.cmd)
+	})
+	defer timer.Stop()
+	return srv.wait()
+}
+
+// stderrSwitch copies the standard error of a server to the writer of
+// the request in progress.
+type stderrSwitch struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *stderrSwitch) set(w io.Writer) {
+	s.mu.Lock()
+	s.w = w
+	s.mu.Unlock()
+}
+
+func (s *stderrSwitch) Write(bs []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(bs)
+}
@@ -0,0 +1,166 @@
+package formatter
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// MappingKind represents the kind of output described by a Mapping.
+type MappingKind int
+
+const (
+	// MappingTag represents an open or close tag.
+	MappingTag MappingKind = iota
+	// MappingText represents a run of text, or the body of a raw
+	// element.
+	MappingText
+	// MappingMacro represents the entire output of a macro.
+	MappingMacro
+)
+
+// A Mapping relates a range of the output of the formatter to the
+// range of source text from which it was produced.
+type Mapping struct {
+	// Kind specifies the kind of output.
+	Kind MappingKind
+	// Output is the range of the output.  Positions are computed as
+	// for source text, with offsets counted from the start of the
+	// output written by a single call to WriteAst or WriteStream.
+	Output ast.Span
+	// Path is the path of the source file, as passed to WriteAst or
+	// WriteStream.
+	Path string
+	// Source is the range of source text.  For tags this is the
+	// entire node, and for macros it is the macro invocation.
+	Source ast.Span
+}
+
+// SourceMap maps the output of the formatter back to the GSP source
+// from which it was produced.  Output produced by a macro is mapped to
+// the macro invocation in its entirety.
+type SourceMap struct {
+	// Mappings holds a mapping for each tag, run of text, and macro
+	// invocation written.  Nodes without a valid span, such as those
+	// created programmatically, are not mapped.
+	Mappings []Mapping
+}
+
+// WriteJSON writes m to w in the JSON format of version 3 of the
+// Source Map specification.  The file parameter is the name of the
+// generated file, and may be empty.
+//
+// The output parameter holds the output mapped by m, and sources the
+// contents of the source files by path.  They are used to count columns
+// in UTF-16 code units as the specification requires.  Columns of
+// positions beyond the given text, such as in a source file missing
+// from sources, count characters instead.
+func (m *SourceMap) WriteJSON(w io.Writer, file string, output []byte,
+	sources map[string][]byte) error {
+	ms := slices.Clone(m.Mappings)
+	slices.SortStableFunc(ms, func(a, b Mapping) int {
+		return cmp.Compare(a.Output.Start.Offset, b.Output.Start.Offset)
+	})
+
+	var (
+		paths   = []string{}
+		indices = make(map[string]int)
+		sb      strings.Builder
+		prev    [4]int /* Previous column, source, line, and column */
+		line    = 1
+		end     ast.Position
+	)
+
+	/* Write a segment at the generated position pos, and with a
+	   source position if src is non-nil */
+	segment := func(pos ast.Position, src []int) {
+		if pos.Line != line {
+			sb.WriteString(strings.Repeat(";", pos.Line-line))
+			line, prev[0] = pos.Line, 0
+		} else if sb.Len() != 0 && !strings.HasSuffix(sb.String(), ";") {
+			sb.WriteByte(',')
+		}
+		col := utf16Column(output, pos)
+		vlq(&sb, col-prev[0])
+		prev[0] = col
+		for i, n := range src {
+			vlq(&sb, n-prev[i+1])
+			prev[i+1] = n
+		}
+	}
+
+	for i, mp := range ms {
+		idx, ok := indices[mp.Path]
+		if !ok {
+			idx = len(paths)
+			indices[mp.Path] = idx
+			paths = append(paths, mp.Path)
+		}
+
+		/* Mark the end of the previous mapping if it does not reach
+		   this one, such that the output in between is unmapped */
+		if i != 0 && end.Offset < mp.Output.Start.Offset {
+			segment(end, nil)
+		}
+		segment(mp.Output.Start, []int{idx, mp.Source.Start.Line - 1,
+			utf16Column(sources[mp.Path], mp.Source.Start)})
+		if mp.Output.End.Offset > end.Offset {
+			end = mp.Output.End
+		}
+	}
+	if len(ms) != 0 {
+		segment(end, nil)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Version  int      `json:"version"`
+		File     string   `json:"file,omitempty"`
+		Sources  []string `json:"sources"`
+		Names    []string `json:"names"`
+		Mappings string   `json:"mappings"`
+	}{3, file, paths, []string{}, sb.String()})
+}
+
+// utf16Column returns the zero-based column of pos in text in UTF-16
+// code units.
+func utf16Column(text []byte, pos ast.Position) int {
+	if pos.Offset > len(text) {
+		return pos.Column - 1
+	}
+	col, bs := 0, text[:pos.Offset]
+	for i := 1; i < pos.Column && len(bs) > 0; i++ {
+		r, n := utf8.DecodeLastRune(bs)
+		col += utf16.RuneLen(r)
+		bs = bs[:len(bs)-n]
+	}
+	return col
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// vlq writes n to sb as a base64 variable-length quantity.
+func vlq(sb *strings.Builder, n int) {
+	v := n << 1
+	if n < 0 {
+		v = -n<<1 | 1
+	}
+	for {
+		d := v & 0x1F
+		v >>= 5
+		if v != 0 {
+			d |= 0x20
+		}
+		sb.WriteByte(base64Digits[d])
+		if v == 0 {
+			return
+		}
+	}
+}
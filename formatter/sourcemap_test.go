@@ -0,0 +1,195 @@
+package formatter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+func TestSourceMap(t *testing.T) {
+	type mapping struct {
+		kind   MappingKind
+		output string /* The mapped output */
+		source string /* The source text it is mapped to */
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		want  []mapping
+	}{
+		{
+			name:  "Tags and text",
+			input: "p .x {-a}\nbr {}",
+			want: []mapping{
+				{MappingTag, `<p class="x">`, "p .x {-a}"},
+				{MappingText, "a", "a"},
+				{MappingTag, "</p>", "p .x {-a}"},
+				{MappingTag, "<br>", "br {}"},
+			},
+		},
+		{
+			name:  "Raw text",
+			input: "style { a {} }",
+			want: []mapping{
+				{MappingTag, "<style>", "style { a {} }"},
+				{MappingText, " a {} ", " a {} "},
+				{MappingTag, "</style>", "style { a {} }"},
+			},
+		},
+		{
+			name:  "Comments",
+			input: "/ p {-a}",
+			opts:  Options{Comments: true},
+			want: []mapping{
+				{MappingTag, "<p>", "p {-a}"},
+				{MappingText, "a", "a"},
+				{MappingTag, "</p>", "p {-a}"},
+			},
+		},
+		{
+			name:  "Omitted end tags",
+			input: "ul { li {-a} li {-b} } p {-c} div {}",
+			opts:  Options{Minify: true},
+			want: []mapping{
+				{MappingTag, "<ul>", "ul { li {-a} li {-b} }"},
+				{MappingTag, "<li>", "li {-a}"},
+				{MappingText, "a", "a"},
+				{MappingTag, "<li>", "li {-b}"},
+				{MappingText, "b", "b"},
+				{MappingTag, "</ul>", "ul { li {-a} li {-b} }"},
+				{MappingTag, "<p>", "p {-c}"},
+				{MappingText, "c", "c"},
+				{MappingTag, "<div>", "div {}"},
+				{MappingTag, "</div>", "div {}"},
+			},
+		},
+		{
+			name:  "Macros",
+			input: "div { $cat { p {-a} } }",
+			opts:  Options{SearchPath: []string{"testdata/macros"}},
+			want: []mapping{
+				{MappingTag, "<div>", "div { $cat { p {-a} } }"},
+				{MappingMacro, "<p>a</p>", "$cat { p {-a} }"},
+				{MappingTag, "</div>", "div { $cat { p {-a} } }"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parser.Parse(strings.NewReader(tt.input), "in.gsp")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			var astOut, streamOut strings.Builder
+			var astMap, streamMap SourceMap
+			opts := tt.opts
+			opts.SourceMap = &astMap
+			if err := WriteAst(&astOut, "in.gsp", nodes, opts); err != nil {
+				t.Fatalf("WriteAst() error = %v", err)
+			}
+			opts.SourceMap = &streamMap
+			dec := parser.NewDecoder(strings.NewReader(tt.input), "in.gsp",
+				parser.Options{})
+			if err := WriteStream(&streamOut, "in.gsp", dec, opts); err != nil {
+				t.Fatalf("WriteStream() error = %v", err)
+			}
+
+			var got []mapping
+			out := astOut.String()
+			for _, m := range astMap.Mappings {
+				if m.Path != "in.gsp" {
+					t.Errorf("Path = %q, want %q", m.Path, "in.gsp")
+				}
+				got = append(got, mapping{
+					m.Kind,
+					out[m.Output.Start.Offset:m.Output.End.Offset],
+					tt.input[m.Source.Start.Offset:m.Source.End.Offset],
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WriteAst() mappings = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(streamMap, astMap) {
+				t.Errorf("WriteStream() mappings = %v, want %v",
+					streamMap.Mappings, astMap.Mappings)
+			}
+		})
+	}
+}
+
+func TestSourceMapWriteJSON(t *testing.T) {
+	pos := func(off, line, col int) ast.Position {
+		return ast.Position{Offset: off, Line: line, Column: col}
+	}
+	span := func(start, end ast.Position) ast.Span {
+		return ast.Span{Start: start, End: end}
+	}
+
+	tests := []struct {
+		name    string
+		m       SourceMap
+		output  string
+		sources map[string][]byte
+		want    string
+	}{
+		{
+			name: "Empty",
+			want: `{"version":3,"file":"out.html","sources":[],"names":[],"mappings":""}`,
+		},
+		{
+			name: "Adjacent mappings",
+			m: SourceMap{Mappings: []Mapping{
+				{MappingText, span(pos(3, 1, 4), pos(4, 1, 5)), "a.gsp",
+					span(pos(5, 1, 6), pos(6, 1, 7))},
+				{MappingTag, span(pos(0, 1, 1), pos(3, 1, 4)), "a.gsp",
+					span(pos(0, 1, 1), pos(7, 1, 8))},
+			}},
+			want: `{"version":3,"file":"out.html","sources":["a.gsp"],"names":[],"mappings":"AAAA,GAAK,C"}`,
+		},
+		{
+			name: "Gaps, lines, and sources",
+			m: SourceMap{Mappings: []Mapping{
+				{MappingTag, span(pos(0, 1, 1), pos(3, 1, 4)), "a.gsp",
+					span(pos(20, 3, 1), pos(27, 3, 8))},
+				{MappingTag, span(pos(40, 3, 5), pos(44, 3, 9)), "b.gsp",
+					span(pos(0, 1, 1), pos(4, 1, 5))},
+			}},
+			want: `{"version":3,"file":"out.html","sources":["a.gsp","b.gsp"],"names":[],"mappings":"AAEA,G;;ICFA,I"}`,
+		},
+		{
+			name: "UTF-16 columns",
+			m: SourceMap{Mappings: []Mapping{
+				{MappingText, span(pos(4, 1, 2), pos(9, 1, 4)), "a.gsp",
+					span(pos(6, 1, 3), pos(11, 1, 5))},
+				{MappingText, span(pos(9, 1, 4), pos(11, 1, 5)), "b.gsp",
+					span(pos(4, 1, 2), pos(6, 1, 3))},
+			}},
+			output: "😀a😀é",
+			sources: map[string][]byte{
+				"a.gsp": []byte("é😀a😀"),
+			},
+			/* b.gsp is missing, so its columns count characters */
+			want: `{"version":3,"file":"out.html","sources":["a.gsp","b.gsp"],"names":[],"mappings":"EAAG,GCAF,C"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			if err := tt.m.WriteJSON(&sb, "out.html", []byte(tt.output),
+				tt.sources); err != nil {
+				t.Fatalf("WriteJSON() error = %v", err)
+			}
+			if got := strings.TrimSuffix(sb.String(), "\n"); got != tt.want {
+				t.Errorf("WriteJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
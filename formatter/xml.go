@@ -0,0 +1,61 @@
+package formatter
+
+import (
+	"strings"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+	"git.thomasvoss.com/gsp/v4/parser"
+)
+
+// xmlChar returns r if it may appear in an XML document, and the
+// replacement character otherwise.
+func xmlChar(r rune) rune {
+	switch {
+	case r == '\t', r == '\n', r == '\r',
+		r >= 0x20 && r <= 0xD7FF,
+		r >= 0xE000 && r <= 0xFFFD,
+		r >= 0x10000 && r <= 0x10FFFF:
+		return r
+	}
+	return '\uFFFD'
+}
+
+// xmlText returns the HTML-escaped text s with any characters that may
+// not appear in XML replaced.
+func xmlText(s string) string {
+	return strings.Map(xmlChar, s)
+}
+
+// xmlAttribute is like xmlText but for attribute values, in which
+// whitespace other than spaces must be escaped to survive attribute
+// value normalization.
+func xmlAttribute(s string) string {
+	return strings.NewReplacer(
+		"\t", "&#9;",
+		"\n", "&#10;",
+		"\r", "&#13;",
+	).Replace(xmlText(s))
+}
+
+// xmlRawText wraps the body s of the Raw node in a CDATA section if it
+// contains markup characters.  The markers of the section are
+// commented out in scripts and styles, such that the document remains
+// valid HTML.
+func xmlRawText(node ast.Node, s string) string {
+	s = xmlText(s)
+	if !strings.ContainsAny(s, "<&") && !strings.Contains(s, "]]>") {
+		return s
+	}
+
+	/* A CDATA section cannot contain its own terminator */
+	s = strings.ReplaceAll(s, "]]>", "]]]]><![CDATA[>")
+
+	ty, _ := node.Attributes.Get("type")
+	switch ty = parser.MediaType(ty); {
+	case node.Name == "script" && scriptTypes[ty] && !jsonTypes[ty]:
+		return "//<![CDATA[\n" + s + "\n//]]>"
+	case node.Name == "style" && (ty == "" || ty == "text/css"):
+		return "/*<![CDATA[*/" + s + "/*]]>*/"
+	}
+	return "<![CDATA[" + s + "]]>"
+}
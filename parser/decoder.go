@@ -0,0 +1,1144 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tdewolff/parse/v2"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// EventKind represents the kind of an Event produced by a Decoder.
+type EventKind int
+
+const (
+	// StartNode marks the beginning of a node.  It is followed by the
+	// node’s attributes, then its children, and finally a matching
+	// EndNode event.
+	StartNode EventKind = iota
+	// Attribute represents a single attribute of the most recently
+	// started node.  Shorthand IDs and classes are reported as
+	// attributes named ‘id’ and ‘class’.
+	Attribute
+	// Text represents a run of text within a text body, or the
+	// contents of a raw body.
+	Text
+	// EndNode marks the end of the most recently started node or
+	// comment.
+	EndNode
+	// Comment marks the beginning of a comment.  It is followed by
+	// the events of the node being commented out and a matching
+	// EndNode event.
+	Comment
+)
+
+// Event represents a single syntactic event within a GSP document.
+type Event struct {
+	// Kind specifies the kind of this event.
+	Kind EventKind
+	// Type holds the type of the node for StartNode, Comment, and
+	// EndNode events.
+	Type ast.NodeType
+	// Name holds the node name for StartNode, Comment, and EndNode
+	// events, the attribute name for Attribute events, and the text
+	// content for Text events.
+	Name string
+	// Value holds the attribute value for Attribute events.
+	Value string
+	// Span is the source range of this event.  For StartNode events
+	// this covers the node name, for Comment events the leading ‘/’,
+	// for Attribute events the attribute name, and for EndNode events
+	// the entire node.
+	Span ast.Span
+	// ValueSpan is the source range of the attribute value for
+	// Attribute events.  It is the zero Span for attributes provided
+	// without a value.
+	ValueSpan ast.Span
+	// Trivia records the syntactic details of StartNode, Comment,
+	// Text, and EndNode events if requested through Options.Trivia,
+	// and is nil otherwise.  EndNode events set Trivia.BeforeBody,
+	// Trivia.Body, and Trivia.Trailing, and all other events only set
+	// Trivia.Leading.
+	Trivia *ast.Trivia
+	// AttributeTrivia is like Trivia but for Attribute events.
+	AttributeTrivia *ast.AttributeTrivia
+}
+
+// A Decoder reads GSP markup from an input stream and produces a
+// stream of syntactic events.  Unlike Parse, a Decoder never holds
+// more of the document in memory than it needs to produce the next
+// event.
+type Decoder struct {
+	ctx   context.Context
+	in    *input
+	path  string
+	opts  Options
+	stack []frame
+	queue []Event
+	errs  ErrorList
+	err   error
+
+	/* Trivia state */
+	space    string /* Whitespace consumed by the last skipSpaces */
+	trailing string /* Whitespace at the end of the document */
+}
+
+type frameKind int
+
+const (
+	headFrame    frameKind = iota /* Parsing a node’s attributes */
+	bodyFrame                     /* Parsing a node’s child nodes */
+	textFrame                     /* Parsing a node’s text body */
+	commentFrame                  /* Parsing a commented-out node */
+)
+
+type frame struct {
+	kind  frameKind
+	ty    ast.NodeType
+	ident string
+	name  string
+	start ast.Position
+	kids  int
+	attrs int
+
+	/* Raw body state */
+	lexer BodyLexer
+	media string /* Value of the ‘type’ attribute */
+
+	open ast.Span /* The opening brace of the body */
+
+	/* Trivia state */
+	before   string
+	body     ast.BodyKind
+	trailing string
+
+	/* Text body state */
+	untrimmed bool
+	depth     int
+	segments  int
+	carry     string /* Text preceding a skipped node */
+	carryPos  ast.Position
+	carrying  bool
+}
+
+// Returned by beginNode when a malformed node was skipped over
+var errSkipped = errors.New("skipped malformed node")
+
+// NewDecoder returns a new Decoder reading from r.  The path and opts
+// parameters have the same meaning as in ParseWithOptions.
+func NewDecoder(r io.Reader, path string, opts Options) *Decoder {
+	return NewDecoderContext(context.Background(), r, path, opts)
+}
+
+// NewDecoderContext is like NewDecoder, but the returned decoder stops
+// decoding once ctx is done.  Next then returns an error wrapping
+// ctx.Err().  A read from r that is already in progress is not
+// interrupted.
+func NewDecoderContext(ctx context.Context, r io.Reader, path string,
+	opts Options) *Decoder {
+	if opts.MaxInputSize > 0 {
+		r = &sizeLimiter{r: r, n: opts.MaxInputSize}
+	}
+	return &Decoder{ctx: ctx, in: newInput(r), path: path, opts: opts}
+}
+
+// Next returns the next event in the document.  At the end of the
+// document Next returns io.EOF.
+//
+// If the decoder is recovering from errors, Next reports no errors
+// other than io.EOF, errors from the underlying reader, and errors
+// caused by the context of the decoder being done; the errors
+// recovered from are instead available through Err.  If the end of the
+// file is reached while parsing a node, an EndNode event is produced
+// for every unterminated node.
+func (d *Decoder) Next() (Event, error) {
+	for len(d.queue) == 0 {
+		if d.err != nil {
+			return Event{}, d.err
+		}
+		if err := d.ctx.Err(); err != nil {
+			d.err = fmt.Errorf("%s: %w", d.path, err)
+			return Event{}, d.err
+		}
+		if err := d.step(); err != nil && err != errSkipped {
+			d.abort(err)
+		}
+	}
+
+	ev := d.queue[0]
+	d.queue = d.queue[1:]
+	return ev, nil
+}
+
+// Err returns the errors that the decoder has recovered from so far
+// as an ErrorList, or nil if there were none.
+func (d *Decoder) Err() error {
+	return d.errs.Err()
+}
+
+// Trailing returns the whitespace at the end of the document once Next
+// has returned io.EOF if trivia was requested through Options.Trivia,
+// and the empty string otherwise.  ParseContext records it in the
+// Trivia of the last node, but a document without nodes has no node
+// to hold it.
+func (d *Decoder) Trailing() string {
+	if !d.opts.Trivia {
+		return ""
+	}
+	return d.trailing
+}
+
+// ReadNode reads the remainder of the node begun by the StartNode or
+// Comment event ev, and returns it as an ast.Node.
+func (d *Decoder) ReadNode(ev Event) (ast.Node, error) {
+	node := ast.Node{Type: ev.Type, Name: ev.Name, Trivia: ev.Trivia}
+
+	for {
+		ev, err := d.Next()
+		if err != nil {
+			return node, err
+		}
+
+		switch ev.Kind {
+		case StartNode, Comment:
+			kid, err := d.ReadNode(ev)
+			node.Children = append(node.Children, kid)
+			if err != nil {
+				return node, err
+			}
+		case Attribute:
+			node.Attributes = append(node.Attributes, ast.Attribute{
+				Key:       ev.Name,
+				Value:     ev.Value,
+				KeySpan:   ev.Span,
+				ValueSpan: ev.ValueSpan,
+				Trivia:    ev.AttributeTrivia,
+			})
+		case Text:
+			node.Children = append(node.Children, ast.Node{
+				Type:   ast.Text,
+				Name:   ev.Name,
+				Span:   ev.Span,
+				Trivia: ev.Trivia,
+			})
+		case EndNode:
+			node.Span = ev.Span
+			if ev.Trivia != nil && node.Trivia != nil {
+				node.Trivia.BeforeBody = ev.Trivia.BeforeBody
+				node.Trivia.Body = ev.Trivia.Body
+				node.Trivia.Trailing = ev.Trivia.Trailing
+			}
+			return node, nil
+		}
+	}
+}
+
+func (d *Decoder) abort(err error) {
+	if err == io.EOF && len(d.stack) == 0 {
+		d.err = io.EOF
+		return
+	}
+	switch err {
+	case io.EOF:
+		err = d.eofError()
+	case errInputSize:
+		err = InputSizeError{d.location(), d.opts.MaxInputSize}
+	}
+
+	if !d.opts.Recover {
+		d.queue = nil
+		d.err = withPath(err, d.path)
+		return
+	}
+
+	/* Errors other than those of the parser are never recovered from */
+	e, ok := withPath(err, d.path).(Error)
+	if !ok {
+		d.queue = nil
+		d.err = err
+		return
+	}
+	d.errs.Add(e)
+	for len(d.stack) != 0 {
+		f := d.pop()
+		d.emit(Event{
+			Kind: EndNode,
+			Type: f.ty,
+			Name: f.name,
+			Span: ast.Span{Start: f.start, End: d.position()},
+		})
+	}
+	d.err = io.EOF
+}
+
+func (d *Decoder) emit(ev Event) {
+	d.queue = append(d.queue, ev)
+}
+
+func (d *Decoder) top() *frame {
+	return &d.stack[len(d.stack)-1]
+}
+
+func (d *Decoder) pop() frame {
+	f := d.stack[len(d.stack)-1]
+	d.stack = d.stack[:len(d.stack)-1]
+	return f
+}
+
+// trivia returns t if the decoder is recording trivia, and nil
+// otherwise.
+func (d *Decoder) trivia(t ast.Trivia) *ast.Trivia {
+	if !d.opts.Trivia {
+		return nil
+	}
+	p := new(ast.Trivia)
+	*p = t
+	return p
+}
+
+// attributeTrivia is like trivia but for attributes.
+func (d *Decoder) attributeTrivia(t ast.AttributeTrivia) *ast.AttributeTrivia {
+	if !d.opts.Trivia {
+		return nil
+	}
+	p := new(ast.AttributeTrivia)
+	*p = t
+	return p
+}
+
+func (d *Decoder) position() ast.Position {
+	return d.in.Position(d.in.Offset())
+}
+
+func (d *Decoder) span(start, end int) ast.Span {
+	return ast.Span{Start: d.in.Position(start), End: d.in.Position(end)}
+}
+
+// location returns the location of the character at the current
+// position.
+func (d *Decoder) location() Location {
+	off := d.in.Offset()
+	_, n := d.in.PeekRune(0)
+	if d.in.Err() != nil {
+		n = 0
+	}
+	return d.locationOf(off, off+n)
+}
+
+// locationOf returns the location of the source text between the
+// absolute offsets start and end.
+func (d *Decoder) locationOf(start, end int) Location {
+	return spanLocation(d.span(start, end))
+}
+
+// eofError returns an EOFError describing the innermost construct left
+// unterminated by the end of the file.
+func (d *Decoder) eofError() EOFError {
+	e := EOFError{Where: d.location()}
+	for i := len(d.stack) - 1; i >= 0; i-- {
+		f := d.stack[i]
+		switch {
+		case f.kind == commentFrame:
+			continue
+		case f.kind == textFrame:
+			e.Construct = fmt.Sprintf("text body of ‘%s’", f.ident)
+		case f.kind == bodyFrame || f.open.Start.IsValid():
+			e.Construct = fmt.Sprintf("body of ‘%s’", f.ident)
+		default:
+			e.Construct = fmt.Sprintf("node ‘%s’", f.ident)
+			e.Open = spanLocation(nameSpan(f.start, f.ident))
+			return e
+		}
+		e.Open = spanLocation(f.open)
+		return e
+	}
+	return e
+}
+
+// unterminated returns an EOFError for the construct opened at open if
+// err is io.EOF, and err otherwise.
+func (d *Decoder) unterminated(err error, open Location, construct string) error {
+	if err != io.EOF {
+		return err
+	}
+	return EOFError{Where: d.location(), Open: open, Construct: construct}
+}
+
+// nameSpan returns the span of the name s starting at start.
+func nameSpan(start ast.Position, s string) ast.Span {
+	end := start
+	end.Offset += len(s)
+	end.Column += utf8.RuneCountInString(s)
+	return ast.Span{Start: start, End: end}
+}
+
+// If the decoder is recovering from errors and err is recoverable,
+// fail records err and returns nil.  Otherwise err is returned as-is.
+func (d *Decoder) fail(err error) error {
+	if !d.opts.Recover {
+		return err
+	}
+	switch err.(type) {
+	case InvalidSyntaxError, InvalidEscapeError, VoidHasChildrenError,
+		RawBodyError:
+		d.errs.Add(withPath(err, d.path).(Error))
+		return nil
+	}
+	return err
+}
+
+func (d *Decoder) step() error {
+	if len(d.stack) == 0 {
+		if err := d.skipSpaces(); err != nil {
+			d.trailing = d.space
+			return err
+		}
+		return d.beginNode()
+	}
+
+	/* Comment frames are never on top of the stack, as they are only
+	   pushed along with the node they comment out */
+	switch f := d.top(); f.kind {
+	case headFrame:
+		return d.stepHead(f)
+	case bodyFrame:
+		return d.stepBody()
+	default:
+		return d.stepText(f)
+	}
+}
+
+func (d *Decoder) beginNode() error {
+	in := d.in
+	var comments []Event
+
+	leading := d.space
+	for in.Peek(0) == '/' {
+		off := in.Offset()
+		comments = append(comments, Event{
+			Kind:   Comment,
+			Type:   ast.Comment,
+			Name:   "/",
+			Span:   d.span(off, off+1),
+			Trivia: d.trivia(ast.Trivia{Leading: leading}),
+		})
+		in.Move(1)
+		if err := d.skipSpaces(); err != nil {
+			return err
+		}
+		leading = d.space
+	}
+
+	start := d.position()
+	ident, span, err := d.parseIdent(false)
+	if err != nil {
+		return d.skipNode(err)
+	}
+
+	if max := d.opts.MaxDepth; max > 0 && len(d.stack)+len(comments) >= max {
+		return DepthLimitError{spanLocation(span), max}
+	}
+
+	if len(d.stack) != 0 {
+		d.top().kids++
+	}
+
+	for _, ev := range comments {
+		d.stack = append(d.stack, frame{
+			kind:  commentFrame,
+			ty:    ast.Comment,
+			name:  "/",
+			start: ev.Span.Start,
+		})
+		d.emit(ev)
+	}
+
+	f := frame{
+		kind:  headFrame,
+		ty:    ast.Normal,
+		ident: ident,
+		name:  ident,
+		start: start,
+	}
+	if e, ok := d.element(ident); ok {
+		f.ty, f.lexer = e.Type, e.Lexer
+	}
+	if ident[0] == '$' {
+		if ident[1] == '$' {
+			f.ty = ast.VerbatimMacro
+			f.name = ident[2:]
+		} else {
+			f.ty = ast.Macro
+			f.name = ident[1:]
+		}
+	}
+
+	d.stack = append(d.stack, f)
+	d.emit(Event{
+		Kind:   StartNode,
+		Type:   f.ty,
+		Name:   f.name,
+		Span:   span,
+		Trivia: d.trivia(ast.Trivia{Leading: leading}),
+	})
+	return nil
+}
+
+func (d *Decoder) endNode() error {
+	f := d.pop()
+	if f.ty == ast.Void && f.kids != 0 {
+		var err error = newVoidHasChildrenError(
+			spanLocation(nameSpan(f.start, f.ident)), f.name)
+		if err = d.fail(err); err != nil {
+			return err
+		}
+	}
+
+	end := d.position()
+	d.emit(Event{
+		Kind: EndNode,
+		Type: f.ty,
+		Name: f.name,
+		Span: ast.Span{Start: f.start, End: end},
+		Trivia: d.trivia(ast.Trivia{
+			BeforeBody: f.before,
+			Body:       f.body,
+			Trailing:   f.trailing,
+		}),
+	})
+
+	for len(d.stack) != 0 && d.top().kind == commentFrame {
+		f := d.pop()
+		d.emit(Event{
+			Kind: EndNode,
+			Type: f.ty,
+			Name: f.name,
+			Span: ast.Span{Start: f.start, End: end},
+		})
+	}
+	return nil
+}
+
+func (d *Decoder) stepHead(f *frame) error {
+	in := d.in
+	if err := d.skipSpaces(); err != nil {
+		return err
+	}
+
+	ch, n := in.PeekRune(0)
+	switch {
+	case ch == '#' || ch == '.':
+		k, at := "id", ast.AttributeTrivia{Form: ast.IDShorthand}
+		if ch == '.' {
+			k, at = "class", ast.AttributeTrivia{Form: ast.ClassShorthand}
+		}
+		ks := in.Offset()
+		kspan := d.span(ks, ks+n)
+		in.Move(n)
+		in.Skip()
+		sh, vspan, err := d.parseShorthand()
+		if err != nil {
+			return d.skipAttribute(err)
+		}
+		if err := d.countAttribute(f, kspan, vspan); err != nil {
+			return err
+		}
+		at.Leading, at.Value = d.space, sh
+		d.emit(Event{
+			Kind:            Attribute,
+			Name:            k,
+			Value:           sh,
+			Span:            kspan,
+			ValueSpan:       vspan,
+			AttributeTrivia: d.attributeTrivia(at),
+		})
+	case validNameStartChar(ch):
+		leading := d.space
+		ev, err := d.parseAttribute()
+		if err != nil {
+			return d.skipAttribute(err)
+		}
+		if err := d.countAttribute(f, ev.Span, ev.ValueSpan); err != nil {
+			return err
+		}
+		if ev.AttributeTrivia != nil {
+			ev.AttributeTrivia.Leading = leading
+		}
+		if ev.Name == "type" && f.media == "" {
+			f.media = ev.Value
+		}
+		d.emit(ev)
+	case ch == '{':
+		f.before = d.space
+		off := in.Offset()
+		f.open = d.span(off, off+n)
+		in.Move(n)
+		in.Skip()
+		if f.ty == ast.Raw {
+			return d.rawBody(f)
+		}
+
+		if ch := in.Peek(0); ch == '-' || ch == '=' {
+			f.open = d.span(off, off+n+1)
+			in.Move(1)
+			in.Skip()
+			f.kind = textFrame
+			f.untrimmed = ch == '='
+			f.depth = 1
+			f.body = ast.TrimmedTextBody
+			if f.untrimmed {
+				f.body = ast.UntrimmedTextBody
+			}
+		} else {
+			f.kind = bodyFrame
+		}
+	default:
+		var err error = newInvalidSyntaxError(d.location(),
+			"node attributes or braces",
+			fmt.Sprintf("invalid character ‘%c’", ch))
+		/* Assume the body was omitted and let the parent node consume
+		   the closing brace */
+		if ch == '}' {
+			if err = d.fail(err); err != nil {
+				return err
+			}
+			return d.endNode()
+		}
+		return d.skipAttribute(err)
+	}
+	return nil
+}
+
+// countAttribute counts an attribute of the node described by f with
+// the given key and value spans against Options.MaxAttributes.
+func (d *Decoder) countAttribute(f *frame, kspan, vspan ast.Span) error {
+	f.attrs++
+	if max := d.opts.MaxAttributes; max > 0 && f.attrs > max {
+		span := kspan
+		if vspan.End.IsValid() {
+			span.End = vspan.End
+		}
+		return AttributeLimitError{spanLocation(span), f.name, max}
+	}
+	return nil
+}
+
+func (d *Decoder) stepBody() error {
+	in := d.in
+	if err := d.skipSpaces(); err != nil {
+		return err
+	}
+
+	if ch, n := in.PeekRune(0); ch == '}' {
+		d.top().trailing = d.space
+		in.Move(n)
+		in.Skip()
+		return d.endNode()
+	}
+	return d.beginNode()
+}
+
+func (d *Decoder) stepText(f *frame) error {
+	in := d.in
+	in.Skip()
+
+	for {
+		if max := d.opts.MaxTextLength; max > 0 && len(in.Lexeme()) > max {
+			return d.textLengthError(in.Offset() - len(in.Lexeme()) + max)
+		}
+
+		switch in.Peek(0) {
+		case 0:
+			err := in.Err()
+			if err == nil {
+				/* A literal NUL byte */
+				break
+			}
+			d.text(f, false)
+			return err
+		case '@':
+			d.text(f, false)
+			in.Move(1)
+			if err := d.skipSpaces(); err != nil {
+				return err
+			}
+
+			err := d.beginNode()
+			if err != errSkipped {
+				return err
+			}
+
+			/* Join the text on either side of the skipped node */
+			ev := d.queue[len(d.queue)-1]
+			d.queue = d.queue[:len(d.queue)-1]
+			f.kids--
+			f.segments--
+			f.carry, f.carryPos, f.carrying = ev.Name, ev.Span.Start, true
+			continue
+		case '{':
+			f.depth++
+		case '}':
+			f.depth--
+			if f.depth == 0 {
+				d.text(f, true)
+				in.Move(1)
+				in.Skip()
+				return d.endNode()
+			}
+		case '\\':
+			in.Move(1)
+			switch ch := in.Peek(0); ch {
+			case 0:
+				/* Ignore escaping EOF so that we throw a syntax error
+				   instead */
+				if in.Err() != nil {
+					continue
+				}
+			case '@', '{', '}', '\\':
+			default:
+				ch, n := in.PeekRune(0)
+				off := in.Offset()
+				err := d.fail(newInvalidEscapeError(
+					d.locationOf(off-1, off+n), ch))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		in.Move(1)
+	}
+}
+
+// textLengthError returns a TextLengthError located at the character
+// containing the byte at the absolute offset off, which must be
+// buffered and not precede the current selection.
+func (d *Decoder) textLengthError(off int) TextLengthError {
+	in := d.in
+	for off > in.base+in.start && !utf8.RuneStart(in.buf[off-in.base]) {
+		off--
+	}
+	_, n := utf8.DecodeRune(in.buf[off-in.base:])
+	return TextLengthError{d.locationOf(off, off+n), d.opts.MaxTextLength}
+}
+
+// text emits the text preceding the current position in the text body
+// described by f.  last indicates that the text ends the text body.
+func (d *Decoder) text(f *frame, last bool) {
+	in := d.in
+	lexStart := in.Offset() - len(in.Lexeme())
+	s := string(in.Shift())
+	start, end := lexStart, in.Offset()
+
+	/* Carried text that was trimmed away entirely has no effect */
+	var pos ast.Position
+	if f.carrying && (f.carry != "" || f.untrimmed || f.segments != 0) {
+		s = f.carry + s
+		pos = f.carryPos
+	}
+	f.carry, f.carrying = "", false
+
+	var leading string
+	if !f.untrimmed {
+		if f.segments == 0 {
+			t := strings.TrimLeftFunc(s, unicode.IsSpace)
+			start += len(s) - len(t)
+			leading, s = s[:len(s)-len(t)], t
+		}
+		if last {
+			t := strings.TrimRightFunc(s, unicode.IsSpace)
+			end = max(end-(len(s)-len(t)), lexStart)
+			f.trailing, s = s[len(t):], t
+		}
+	}
+
+	if !pos.IsValid() {
+		pos = in.Position(start)
+	}
+
+	f.kids++
+	f.segments++
+	d.emit(Event{
+		Kind:   Text,
+		Name:   s,
+		Span:   ast.Span{Start: pos, End: in.Position(end)},
+		Trivia: d.trivia(ast.Trivia{Leading: leading}),
+	})
+}
+
+// element returns the element table entry for the named element.
+func (d *Decoder) element(name string) (Element, bool) {
+	if e, ok := d.opts.Elements[name]; ok {
+		return e, true
+	}
+	e, ok := defaultElements[name]
+	return e, ok
+}
+
+func (d *Decoder) rawBody(f *frame) error {
+	lex := f.lexer
+	if l, ok := d.opts.MediaTypes[MediaType(f.media)]; ok && f.media != "" {
+		lex = l
+	}
+	if lex == nil {
+		lex = LexJS
+	}
+
+	in := d.in
+	for {
+		bs := in.Buffered()
+		n, errs, ok := lex(bs[:len(bs):len(bs)])
+
+		if max := d.opts.MaxTextLength; max > 0 &&
+			(ok && n > max || !ok && len(bs) > max) {
+			return d.textLengthError(in.Offset() + max)
+		}
+		if !ok && in.err == nil {
+			in.fill(2*len(bs) + chunkSize)
+			continue
+		}
+		for _, err := range errs {
+			if err = d.fail(d.rawBodyError(f, bs, err)); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			in.Move(len(bs))
+			return in.err
+		}
+
+		start := in.Offset()
+		in.Move(n)
+		d.emit(Event{
+			Kind: Text,
+			Name: string(in.Shift()),
+			Span: d.span(start, in.Offset()),
+		})
+		f.kids++
+		in.Move(1)
+		in.Skip()
+		return d.endNode()
+	}
+}
+
+// rawBodyError converts an error reported by the lexer of the raw body
+// bs of f into a RawBodyError.  The positions of errors from the
+// lexers of the parse package are relative to the body, and are made
+// absolute.
+func (d *Decoder) rawBodyError(f *frame, bs []byte, err error) RawBodyError {
+	pe, ok := err.(*parse.Error)
+	if !ok {
+		return newRawBodyError(spanLocation(f.open), err.Error())
+	}
+
+	/* Find the offset of the reported line and column */
+	line, col := 1, 1
+	var i int
+	for i < len(bs) && (line < pe.Line || line == pe.Line && col < pe.Column) {
+		r, n := utf8.DecodeRune(bs[i:])
+		i += n
+		switch {
+		case r == '\r' && i < len(bs) && bs[i] == '\n':
+		case r == '\r', r == '\n', r == '\v', r == '\f',
+			r == '\u0085', r == '\u2028', r == '\u2029':
+			line++
+			col = 1
+		default:
+			col++
+		}
+	}
+
+	off := d.in.Offset() + i
+	_, n := utf8.DecodeRune(bs[i:])
+	if i == len(bs) {
+		n = 0
+	}
+	return newRawBodyError(d.locationOf(off, off+n), pe.Message)
+}
+
+// Skip over the remainder of a malformed node up to and including its
+// body, such that parsing may resume at the next sibling.  A closing
+// brace belonging to the parent is not consumed.
+func (d *Decoder) skipNode(err error) error {
+	if err = d.fail(err); err != nil {
+		return err
+	}
+
+	in := d.in
+	for {
+		r, n := in.PeekRune(0)
+		switch {
+		case r == 0 && in.Err() != nil:
+			return in.Err()
+		case r == '}':
+			/* A closing brace at the top level has no parent, and
+			   would otherwise be parsed again and again */
+			if len(d.stack) == 0 {
+				in.Move(n)
+			}
+			in.Skip()
+			return errSkipped
+		case r == '{':
+			in.Move(n)
+			if err := d.skipBraces(); err != nil {
+				return err
+			}
+			return errSkipped
+		}
+		in.Move(n)
+		in.Skip()
+	}
+}
+
+// Skip over the remainder of a malformed attribute, stopping at the
+// next space or brace.
+func (d *Decoder) skipAttribute(err error) error {
+	if err = d.fail(err); err != nil {
+		return err
+	}
+
+	in := d.in
+	for {
+		r, n := in.PeekRune(0)
+		switch {
+		case r == 0 && in.Err() != nil:
+			return in.Err()
+		case r == '{' || r == '}' || unicode.IsSpace(r):
+			in.Skip()
+			return nil
+		}
+		in.Move(n)
+	}
+}
+
+// Skip to just past the brace matching an already consumed opening
+// brace.
+func (d *Decoder) skipBraces() error {
+	in := d.in
+	depth := 1
+	for depth > 0 {
+		ch := in.Peek(0)
+		if ch == 0 && in.Err() != nil {
+			return in.Err()
+		}
+		in.Move(1)
+		switch ch {
+		case '\\':
+			in.Move(1)
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		/* Nothing skipped is ever needed again */
+		in.Skip()
+	}
+	return nil
+}
+
+func (d *Decoder) parseIdent(attr bool) (string, ast.Span, error) {
+	in := d.in
+	in.Skip()
+	start := in.Offset()
+	r, n := in.PeekRune(0)
+	if r == 0 && in.Err() != nil {
+		return "", ast.Span{}, in.Err()
+	}
+
+	if !validNameStartChar(r) {
+		expected := "node name"
+		if attr {
+			expected = "attribute name"
+		}
+		return "", ast.Span{}, newInvalidSyntaxError(d.location(),
+			expected,
+			fmt.Sprintf("invalid character ‘%c’", r))
+	} else if !attr && !validNameChar(r) {
+		return "", ast.Span{}, newInvalidSyntaxError(d.location(),
+			"class/id shorthand",
+			fmt.Sprintf("invalid character ‘%c’", r))
+	}
+
+	in.Move(n)
+	for {
+		r, n = in.PeekRune(0)
+		if r == 0 && in.Err() != nil {
+			break
+		}
+		if !validNameChar(r) {
+			break
+		}
+		in.Move(n)
+	}
+
+	span := d.span(start, in.Offset())
+	s := string(in.Shift())
+	if !attr && s == "$" || s == "$$" {
+		return "", ast.Span{}, newInvalidSyntaxError(spanLocation(span),
+			"macro name", "nothing")
+	}
+	return s, span, nil
+}
+
+func (d *Decoder) parseShorthand() (string, ast.Span, error) {
+	in := d.in
+	start := in.Offset()
+	r, n := in.PeekRune(0)
+	if r == 0 && in.Err() != nil {
+		return "", ast.Span{}, in.Err()
+	}
+
+	if !validNameChar(r) {
+		return "", ast.Span{}, newInvalidSyntaxError(d.location(),
+			"id/class identifier",
+			fmt.Sprintf("invalid character ‘%c’", r))
+	}
+
+	in.Move(n)
+	for {
+		r, n = in.PeekRune(0)
+		if r == 0 && in.Err() != nil {
+			break
+		}
+		if !validNameChar(r) {
+			break
+		}
+		in.Move(n)
+	}
+
+	return string(in.Shift()), d.span(start, in.Offset()), nil
+}
+
+// parseAttribute parses a long-form attribute and returns it as an
+// Attribute event.
+func (d *Decoder) parseAttribute() (Event, error) {
+	in := d.in
+	k, kspan, err := d.parseIdent(true)
+	if err != nil {
+		return Event{}, err
+	}
+
+	ev := Event{Kind: Attribute, Name: k, Span: kspan}
+	r, n := in.PeekRune(0)
+	if r == 0 && in.Err() != nil {
+		return Event{}, in.Err()
+	} else if r != '=' {
+		ev.AttributeTrivia = d.attributeTrivia(ast.AttributeTrivia{
+			Form: ast.BareAttribute,
+		})
+		return ev, nil
+	}
+
+	in.Move(n)
+	in.Skip()
+
+	start := d.position()
+	v, raw, err := d.parseString()
+	if err != nil {
+		return Event{}, err
+	}
+
+	ev.Value = v
+	ev.ValueSpan = ast.Span{Start: start, End: d.position()}
+	ev.AttributeTrivia = d.attributeTrivia(ast.AttributeTrivia{
+		Form:  ast.QuotedAttribute,
+		Value: v,
+		Raw:   raw,
+	})
+	return ev, nil
+}
+
+// parseString parses a double-quoted string and returns its value.  If
+// the decoder is recording trivia, the string is also returned as it
+// was written between the quotes.
+func (d *Decoder) parseString() (string, string, error) {
+	in := d.in
+	r, n := in.PeekRune(0)
+	if r == 0 && in.Err() != nil {
+		return "", "", in.Err()
+	} else if r != '"' {
+		return "", "", newInvalidSyntaxError(d.location(),
+			"double-quoted string",
+			fmt.Sprintf("‘%c’", r))
+	}
+	off := in.Offset()
+	quote := d.locationOf(off, off+n)
+	in.Move(n)
+	in.Skip()
+
+	var sb, raw strings.Builder
+	start := in.Offset()
+	for {
+		r, n := in.PeekRune(0)
+		if r == 0 && in.Err() != nil {
+			return "", "", d.unterminated(in.Err(), quote, "string")
+		}
+		max := d.opts.MaxTextLength
+		if max > 0 && r != '"' && in.Offset()+n-start > max {
+			return "", "", d.textLengthError(in.Offset())
+		}
+		in.Move(n)
+
+		switch r {
+		case '"':
+			in.Skip()
+			return sb.String(), raw.String(), nil
+		case '\\':
+			r2, n2 := in.PeekRune(0)
+			if r2 == 0 && in.Err() != nil {
+				return "", "", d.unterminated(in.Err(), quote, "string")
+			}
+			off := in.Offset()
+			in.Move(n2)
+
+			if r2 != '\\' && r2 != '"' {
+				err := d.fail(newInvalidEscapeError(
+					d.locationOf(off-1, off+n2), r2))
+				if err != nil {
+					return "", "", err
+				}
+			}
+			sb.WriteRune(r2)
+		default:
+			sb.WriteRune(r)
+		}
+		if d.opts.Trivia {
+			raw.Write(in.Lexeme())
+		}
+		in.Skip()
+	}
+}
+
+// skipSpaces skips over any whitespace at the current position.  If
+// the decoder is recording trivia, the whitespace is stored in d.space.
+func (d *Decoder) skipSpaces() error {
+	in := d.in
+	start := in.Offset()
+	for {
+		r, n := in.PeekRune(0)
+		if r == 0 && in.Err() != nil {
+			d.saveSpace(start)
+			return in.Err()
+		}
+		if unicode.IsSpace(r) {
+			in.Move(n)
+		} else {
+			d.saveSpace(start)
+			in.Skip()
+			return nil
+		}
+	}
+}
+
+func (d *Decoder) saveSpace(start int) {
+	if d.opts.Trivia {
+		bs := d.in.Lexeme()
+		d.space = string(bs[len(bs)-(d.in.Offset()-start):])
+	}
+}
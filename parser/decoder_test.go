@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+func TestDecoder(t *testing.T) {
+	input := `/ div {} p .x {- a @em{=b} } style {a{}}`
+	want := []Event{
+		{Kind: Comment, Type: ast.Comment, Name: "/"},
+		{Kind: StartNode, Type: ast.Normal, Name: "div"},
+		{Kind: EndNode, Type: ast.Normal, Name: "div"},
+		{Kind: EndNode, Type: ast.Comment, Name: "/"},
+		{Kind: StartNode, Type: ast.Normal, Name: "p"},
+		{Kind: Attribute, Name: "class", Value: "x"},
+		{Kind: Text, Name: "a "},
+		{Kind: StartNode, Type: ast.Normal, Name: "em"},
+		{Kind: Text, Name: "b"},
+		{Kind: EndNode, Type: ast.Normal, Name: "em"},
+		{Kind: Text, Name: ""},
+		{Kind: EndNode, Type: ast.Normal, Name: "p"},
+		{Kind: StartNode, Type: ast.Raw, Name: "style"},
+		{Kind: Text, Name: "a{}"},
+		{Kind: EndNode, Type: ast.Raw, Name: "style"},
+	}
+
+	d := NewDecoder(strings.NewReader(input), "<string>", Options{})
+	var got []Event
+	for {
+		ev, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		ev.Span, ev.ValueSpan = ast.Span{}, ast.Span{}
+		got = append(got, ev)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Next() \ngot  = %v\nwant = %v", got, want)
+	}
+}
+
+func TestDecoderSmallReads(t *testing.T) {
+	inputs := []string{
+		"html lang=\"en\" {\n\thead { title {- Hi } }\n\tbody #b {= x @br{} y }\n}",
+		"script { const s = \"}\"; /* } */ f(`${a}`); }",
+		"style { a { color: red; } /* } */ }",
+		"script {" + strings.Repeat("x = {a: '}'};\n", 10000) + "}",
+		"p {- " + strings.Repeat("lorem ipsum ", 10000) + "}",
+	}
+
+	for _, input := range inputs {
+		want, err := Parse(strings.NewReader(input), "<string>")
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		got, err := Parse(iotest.OneByteReader(strings.NewReader(input)),
+			"<string>")
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Parse() differs when reading one byte at a time:"+
+				"\ngot  = %v\nwant = %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+	"github.com/tdewolff/parse/v2/js"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+// A BodyLexer finds the end of a raw body.  It is passed the input
+// following the opening brace of the body and returns the length of
+// the body up to but excluding the closing brace, along with any
+// errors encountered.
+//
+// If the end of the input is reached before the closing brace, the
+// lexer reports false and is called again once more input is
+// available.  The lexer must not modify or retain the input.
+type BodyLexer func(input []byte) (int, []error, bool)
+
+// Element describes how the parser treats an element.
+type Element struct {
+	// Type is the type of the nodes parsed for the element.
+	Type ast.NodeType
+	// Lexer finds the end of the body of the element when Type is
+	// ast.Raw.  If nil, LexJS is used.
+	Lexer BodyLexer
+}
+
+var defaultElements = map[string]Element{
+	"area":     {Type: ast.Void},
+	"base":     {Type: ast.Void},
+	"br":       {Type: ast.Void},
+	"col":      {Type: ast.Void},
+	"embed":    {Type: ast.Void},
+	"hr":       {Type: ast.Void},
+	"img":      {Type: ast.Void},
+	"input":    {Type: ast.Void},
+	"link":     {Type: ast.Void},
+	"meta":     {Type: ast.Void},
+	"param":    {Type: ast.Void},
+	"script":   {Type: ast.Raw, Lexer: LexJS},
+	"source":   {Type: ast.Void},
+	"style":    {Type: ast.Raw, Lexer: LexCSS},
+	"textarea": {Type: ast.Escapable},
+	"title":    {Type: ast.Escapable},
+	"track":    {Type: ast.Void},
+	"wbr":      {Type: ast.Void},
+}
+
+// DefaultElements returns a copy of the element table used by the
+// parser for elements not configured through Options.Elements.
+// Elements not present in the table are of type ast.Normal.
+func DefaultElements() map[string]Element {
+	return maps.Clone(defaultElements)
+}
+
+// LexCSS is a BodyLexer for CSS bodies.
+func LexCSS(input []byte) (int, []error, bool) {
+	var errs []error
+	depth := 1
+	in := parse.NewInputBytes(input)
+	l := css.NewLexer(in)
+
+	for {
+		tt, _ := l.Next()
+		switch tt {
+		case css.ErrorToken:
+			if in.Offset() >= in.Len() {
+				return 0, errs, false
+			}
+			errs = append(errs, l.Err())
+		case css.LeftBraceToken:
+			depth++
+		case css.RightBraceToken:
+			depth--
+			if depth == 0 {
+				return in.Offset() - 1, errs, true
+			}
+		}
+	}
+}
+
+// LexJS is a BodyLexer for JavaScript bodies.  As JSON is a subset of
+// JavaScript, it is also suitable for JSON bodies.
+func LexJS(input []byte) (int, []error, bool) {
+	var errs []error
+	depth := 1
+	in := parse.NewInputBytes(input)
+	l := js.NewLexer(in)
+
+	for {
+		tt, _ := l.Next()
+		switch tt {
+		case js.ErrorToken:
+			/* Errors at the end of the input may be caused by a token
+			   that has not been read in full */
+			if in.Offset() >= in.Len() {
+				return 0, errs, false
+			}
+			errs = append(errs, l.Err())
+		case js.OpenBraceToken:
+			depth++
+		case js.CloseBraceToken:
+			depth--
+			if depth == 0 {
+				return in.Offset() - 1, errs, true
+			}
+		}
+	}
+}
+
+// LexBraces is a BodyLexer for bodies of arbitrary text in which braces
+// are balanced, such as most templating languages.  The body ends at
+// the first closing brace without a matching opening brace.
+func LexBraces(input []byte) (int, []error, bool) {
+	depth := 1
+	for i, b := range input {
+		switch b {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i, nil, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// MediaType returns the media type s without parameters, in lowercase,
+// as is used to compare the values of type attributes.
+func MediaType(s string) string {
+	s, _, _ = strings.Cut(s, ";")
+	return strings.ToLower(strings.TrimSpace(s))
+}
@@ -1,10 +1,12 @@
 package parser
 
 import (
-	"bytes"
+	"cmp"
 	"fmt"
+	"slices"
+	"strings"
 
-	"github.com/tdewolff/parse/v2"
+	"git.thomasvoss.com/gsp/v4/ast"
 )
 
 // Location represents the location at which an error occured.
@@ -12,15 +14,128 @@ type Location struct {
 	Path string
 	Row  int
 	Col  int
+	// Span is the range of source text to which the error pertains.
+	// It may be empty, such as for errors at the end of the file.
+	Span ast.Span
+}
+
+func spanLocation(span ast.Span) Location {
+	return Location{"", span.Start.Line, span.Start.Column, span}
 }
 
 func (l Location) String() string {
 	return fmt.Sprintf("%s:%d:%d", l.Path, l.Row, l.Col-1)
 }
 
-func locFromInput(in *parse.Input) Location {
-	row, col, _ := parse.Position(bytes.NewReader(in.Bytes()), in.Offset())
-	return Location{"", row, col}
+// Severity represents the severity of an Error.
+type Severity int
+
+const (
+	// SeverityError represents an error which prevents a document from
+	// being processed correctly.
+	SeverityError Severity = iota
+	// SeverityWarning represents a problem which does not prevent a
+	// document from being processed.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Error is implemented by every error the parser reports about a
+// document, allowing errors to be inspected without knowing their
+// concrete type.
+type Error interface {
+	error
+	// Position returns the location to which the error pertains.
+	Position() Location
+	// Severity returns the severity of the error.
+	Severity() Severity
+	// Message returns the error message without the location.
+	Message() string
+	// Code returns a short identifier for the kind of the error which
+	// is stable across releases, such as ‘syntax’.
+	Code() string
+}
+
+type pathSetter interface {
+	withPath(path string) error
+}
+
+func withPath(err error, path string) error {
+	if e, ok := err.(pathSetter); ok {
+		return e.withPath(path)
+	}
+	return err
+}
+
+// ErrorList is a list of errors.  It implements the error interface,
+// and wraps each of its errors such that they can be found with
+// errors.Is and errors.As.
+type ErrorList []Error
+
+// Add appends err to the list.
+func (l *ErrorList) Add(err Error) {
+	*l = append(*l, err)
+}
+
+// Sort sorts the list by path and then by position.  Errors at the same
+// position are sorted by message.
+func (l ErrorList) Sort() {
+	slices.SortStableFunc(l, compareErrors)
+}
+
+// RemoveMultiples sorts the list and removes all but the first of any
+// errors with the same position, code, and message.
+func (l *ErrorList) RemoveMultiples() {
+	l.Sort()
+	*l = slices.CompactFunc(*l, func(a, b Error) bool {
+		return compareErrors(a, b) == 0 && a.Code() == b.Code()
+	})
+}
+
+func compareErrors(a, b Error) int {
+	p, q := a.Position(), b.Position()
+	return cmp.Or(
+		cmp.Compare(p.Path, q.Path),
+		cmp.Compare(p.Row, q.Row),
+		cmp.Compare(p.Col, q.Col),
+		cmp.Compare(a.Message(), b.Message()),
+	)
+}
+
+// Err returns l as an error, or nil if the list is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// Error returns the messages of all errors in the list, separated by
+// newlines.
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors in the list.
+func (l ErrorList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for i, err := range l {
+		errs[i] = err
+	}
+	return errs
 }
 
 // InvalidSyntaxError indicates that the parser encountered an
@@ -31,13 +146,26 @@ type InvalidSyntaxError struct {
 	Found    string
 }
 
-func newInvalidSyntaxError(in *parse.Input, expected, found string) InvalidSyntaxError {
-	return InvalidSyntaxError{locFromInput(in), expected, found}
+func newInvalidSyntaxError(loc Location, expected, found string) InvalidSyntaxError {
+	return InvalidSyntaxError{loc, expected, found}
 }
 
 func (e InvalidSyntaxError) Error() string {
-	return fmt.Sprintf("%s: syntax error: expected %s but found %s",
-		e.Where, e.Expected, e.Found)
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e InvalidSyntaxError) Message() string {
+	return fmt.Sprintf("syntax error: expected %s but found %s",
+		e.Expected, e.Found)
+}
+
+func (e InvalidSyntaxError) Position() Location { return e.Where }
+func (e InvalidSyntaxError) Severity() Severity { return SeverityError }
+func (e InvalidSyntaxError) Code() string       { return "syntax" }
+
+func (e InvalidSyntaxError) withPath(path string) error {
+	e.Where.Path = path
+	return e
 }
 
 // InvalidEscapeError indicates that an invalid escape sequence was
@@ -47,13 +175,25 @@ type InvalidEscapeError struct {
 	Rune  rune
 }
 
-func newInvalidEscapeError(in *parse.Input, got rune) InvalidEscapeError {
-	return InvalidEscapeError{locFromInput(in), got}
+func newInvalidEscapeError(loc Location, got rune) InvalidEscapeError {
+	return InvalidEscapeError{loc, got}
 }
 
 func (e InvalidEscapeError) Error() string {
-	return fmt.Sprintf("%s: invalid escape sequence: ‘\\%c’",
-		e.Where, e.Rune)
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e InvalidEscapeError) Message() string {
+	return fmt.Sprintf("invalid escape sequence: ‘\\%c’", e.Rune)
+}
+
+func (e InvalidEscapeError) Position() Location { return e.Where }
+func (e InvalidEscapeError) Severity() Severity { return SeverityError }
+func (e InvalidEscapeError) Code() string       { return "escape" }
+
+func (e InvalidEscapeError) withPath(path string) error {
+	e.Where.Path = path
+	return e
 }
 
 // VoidHasChildrenError indicates that an HTML void element (such as
@@ -63,19 +203,186 @@ type VoidHasChildrenError struct {
 	Tag   string
 }
 
-func newVoidHasChildrenError(in *parse.Input, tag string) VoidHasChildrenError {
-	return VoidHasChildrenError{locFromInput(in), tag}
+func newVoidHasChildrenError(loc Location, tag string) VoidHasChildrenError {
+	return VoidHasChildrenError{loc, tag}
 }
 
 func (e VoidHasChildrenError) Error() string {
-	return fmt.Sprintf("%s: void element ‘%s’ may not have any child nodes",
-		e.Where, e.Tag)
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e VoidHasChildrenError) Message() string {
+	return fmt.Sprintf("void element ‘%s’ may not have any child nodes",
+		e.Tag)
+}
+
+func (e VoidHasChildrenError) Position() Location { return e.Where }
+func (e VoidHasChildrenError) Severity() Severity { return SeverityError }
+func (e VoidHasChildrenError) Code() string       { return "void-children" }
+
+func (e VoidHasChildrenError) withPath(path string) error {
+	e.Where.Path = path
+	return e
+}
+
+// RawBodyError indicates that the lexer of a raw body, such as that of
+// a style or script node, encountered an error.
+type RawBodyError struct {
+	Where  Location
+	Reason string
+}
+
+func newRawBodyError(loc Location, reason string) RawBodyError {
+	return RawBodyError{loc, reason}
+}
+
+func (e RawBodyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e RawBodyError) Message() string {
+	return "invalid raw body: " + e.Reason
+}
+
+func (e RawBodyError) Position() Location { return e.Where }
+func (e RawBodyError) Severity() Severity { return SeverityError }
+func (e RawBodyError) Code() string       { return "raw-body" }
+
+func (e RawBodyError) withPath(path string) error {
+	e.Where.Path = path
+	return e
 }
 
 // EOFError indicates that the parser reached the end of the file
 // unexpectedly while parsing a construct.
-type EOFError struct{}
+type EOFError struct {
+	Where Location
+	// Open is the location at which the innermost unterminated
+	// construct was opened, and Construct describes it.  Both are zero
+	// if the construct is unknown.
+	Open      Location
+	Construct string
+}
 
 func (e EOFError) Error() string {
-	return "reached end of file while parsing"
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e EOFError) Message() string {
+	if e.Construct == "" {
+		return "reached end of file while parsing"
+	}
+	return fmt.Sprintf("reached end of file while parsing %s (opened at %s)",
+		e.Construct, e.Open)
+}
+
+func (e EOFError) Position() Location { return e.Where }
+func (e EOFError) Severity() Severity { return SeverityError }
+func (e EOFError) Code() string       { return "eof" }
+
+func (e EOFError) withPath(path string) error {
+	e.Where.Path = path
+	e.Open.Path = path
+	return e
+}
+
+// DepthLimitError indicates that nodes were nested more deeply than
+// permitted by Options.MaxDepth.
+type DepthLimitError struct {
+	Where Location
+	Limit int
+}
+
+func (e DepthLimitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e DepthLimitError) Message() string {
+	return fmt.Sprintf("nodes nested more than %d levels deep", e.Limit)
+}
+
+func (e DepthLimitError) Position() Location { return e.Where }
+func (e DepthLimitError) Severity() Severity { return SeverityError }
+func (e DepthLimitError) Code() string       { return "depth-limit" }
+
+func (e DepthLimitError) withPath(path string) error {
+	e.Where.Path = path
+	return e
+}
+
+// InputSizeError indicates that the document is larger than permitted
+// by Options.MaxInputSize.  The error is located at the first byte
+// past the limit.
+type InputSizeError struct {
+	Where Location
+	Limit int64
+}
+
+func (e InputSizeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e InputSizeError) Message() string {
+	return fmt.Sprintf("document larger than %d bytes", e.Limit)
+}
+
+func (e InputSizeError) Position() Location { return e.Where }
+func (e InputSizeError) Severity() Severity { return SeverityError }
+func (e InputSizeError) Code() string       { return "input-size" }
+
+func (e InputSizeError) withPath(path string) error {
+	e.Where.Path = path
+	return e
+}
+
+// AttributeLimitError indicates that a node was given more attributes
+// than permitted by Options.MaxAttributes.  The error is located at
+// the first attribute past the limit.
+type AttributeLimitError struct {
+	Where Location
+	Node  string
+	Limit int
+}
+
+func (e AttributeLimitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e AttributeLimitError) Message() string {
+	return fmt.Sprintf("node ‘%s’ has more than %d attributes",
+		e.Node, e.Limit)
+}
+
+func (e AttributeLimitError) Position() Location { return e.Where }
+func (e AttributeLimitError) Severity() Severity { return SeverityError }
+func (e AttributeLimitError) Code() string       { return "attribute-limit" }
+
+func (e AttributeLimitError) withPath(path string) error {
+	e.Where.Path = path
+	return e
+}
+
+// TextLengthError indicates that a run of text, raw body, or attribute
+// value is longer than permitted by Options.MaxTextLength.  The error
+// is located at the first character past the limit.
+type TextLengthError struct {
+	Where Location
+	Limit int
+}
+
+func (e TextLengthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Where, e.Message())
+}
+
+func (e TextLengthError) Message() string {
+	return fmt.Sprintf("text longer than %d bytes", e.Limit)
+}
+
+func (e TextLengthError) Position() Location { return e.Where }
+func (e TextLengthError) Severity() Severity { return SeverityError }
+func (e TextLengthError) Code() string       { return "text-length" }
+
+func (e TextLengthError) withPath(path string) error {
+	e.Where.Path = path
+	return e
 }
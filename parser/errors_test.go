@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestErrorList(t *testing.T) {
+	loc := func(path string, row, col int) Location {
+		return Location{Path: path, Row: row, Col: col}
+	}
+
+	syn := newInvalidSyntaxError(loc("b.gsp", 1, 4), "node name", "‘1’")
+	esc := newInvalidEscapeError(loc("a.gsp", 3, 2), 'q')
+	void := newVoidHasChildrenError(loc("a.gsp", 1, 9), "br")
+	eof := EOFError{Where: loc("a.gsp", 9, 1)}
+
+	l := ErrorList{syn, esc, void, esc, eof, syn}
+	l.RemoveMultiples()
+	if want := (ErrorList{void, esc, eof, syn}); !reflect.DeepEqual(l, want) {
+		t.Errorf("RemoveMultiples() = %v, want %v", l, want)
+	}
+
+	err := l.Err()
+	var got InvalidEscapeError
+	if !errors.As(err, &got) || got != esc {
+		t.Errorf("errors.As() = %v, want %v", got, esc)
+	}
+	if !errors.Is(err, eof) {
+		t.Errorf("errors.Is(%v) = false, want true", eof)
+	}
+	if errors.Is(err, io.EOF) {
+		t.Errorf("errors.Is(io.EOF) = true, want false")
+	}
+
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 4 {
+		t.Errorf("errors.As() = %v, want the error list", list)
+	}
+	if err := (ErrorList{}).Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
+
+func TestErrorInterface(t *testing.T) {
+	_, err := ParseWithOptions(strings.NewReader("p {- \\q } br { a {} } p {"),
+		"x.gsp", Options{Recover: true})
+
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("ParseWithOptions() error = %v, want an ErrorList", err)
+	}
+
+	var codes []string
+	for _, e := range list {
+		if e.Position().Path != "x.gsp" {
+			t.Errorf("%v: path = %q, want %q", e, e.Position().Path, "x.gsp")
+		}
+		if e.Severity() != SeverityError {
+			t.Errorf("%v: severity = %v, want %v", e, e.Severity(), SeverityError)
+		}
+		if want := e.Position().String() + ": " + e.Message(); e.Error() != want {
+			t.Errorf("Error() = %q, want %q", e.Error(), want)
+		}
+		codes = append(codes, e.Code())
+	}
+
+	want := []string{"escape", "void-children", "eof"}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("codes = %v, want %v", codes, want)
+	}
+}
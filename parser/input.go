@@ -0,0 +1,212 @@
+package parser
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+
+	"git.thomasvoss.com/gsp/v4/ast"
+)
+
+const chunkSize = 64 << 10
+
+// input is a buffered reader offering the same peek-and-shift
+// interface as parse.Input.  Unlike parse.Input it reads from the
+// underlying reader on demand and discards everything before the
+// start of the current selection, so that arbitrarily large documents
+// can be parsed in bounded memory.
+type input struct {
+	r   io.Reader
+	err error
+
+	buf   []byte
+	base  int /* Absolute offset of buf[0] */
+	start int /* Start of the current selection in buf */
+	pos   int /* End of the current selection in buf */
+
+	/* A known position at or before the current selection, from which
+	   the positions of later offsets are computed */
+	mark   ast.Position
+	markCR bool /* The byte before mark is a carriage return */
+}
+
+func newInput(r io.Reader) *input {
+	return &input{
+		r:    r,
+		mark: ast.Position{Offset: 0, Line: 1, Column: 1},
+	}
+}
+
+// fill attempts to ensure that at least n bytes are buffered past the
+// current position, and reports whether it succeeded.
+func (in *input) fill(n int) bool {
+	for len(in.buf)-in.pos < n {
+		if in.err != nil {
+			return false
+		}
+
+		if in.start > len(in.buf)/2 {
+			in.advanceMark(in.base + in.start)
+			m := copy(in.buf, in.buf[in.start:])
+			in.buf = in.buf[:m]
+			in.base += in.start
+			in.pos -= in.start
+			in.start = 0
+		}
+		if cap(in.buf)-len(in.buf) < chunkSize {
+			buf := make([]byte, len(in.buf), 2*cap(in.buf)+chunkSize)
+			copy(buf, in.buf)
+			in.buf = buf
+		}
+
+		m, err := in.r.Read(in.buf[len(in.buf):cap(in.buf)])
+		in.buf = in.buf[:len(in.buf)+m]
+		if err != nil {
+			in.err = err
+		}
+	}
+	return true
+}
+
+// Peek returns the ith byte after the current position, or 0 if there
+// is no such byte.
+func (in *input) Peek(i int) byte {
+	if !in.fill(i + 1) {
+		return 0
+	}
+	return in.buf[in.pos+i]
+}
+
+// PeekRune returns the rune starting at the ith byte after the current
+// position along with its width in bytes.
+func (in *input) PeekRune(i int) (rune, int) {
+	in.fill(i + utf8.UTFMax)
+	if in.pos+i >= len(in.buf) {
+		return 0, 1
+	}
+	return utf8.DecodeRune(in.buf[in.pos+i:])
+}
+
+// Err returns the error that prevents reading the byte at the current
+// position, which is io.EOF at the end of the input.
+func (in *input) Err() error {
+	return in.PeekErr(0)
+}
+
+// PeekErr is like Err but for the ith byte after the current position.
+func (in *input) PeekErr(i int) error {
+	if in.pos+i < 0 || in.fill(i+1) {
+		return nil
+	}
+	return in.err
+}
+
+// Move advances the current position by n bytes.
+func (in *input) Move(n int) {
+	in.pos += n
+}
+
+// Skip collapses the current selection to the current position.
+func (in *input) Skip() {
+	in.start = in.pos
+}
+
+// Lexeme returns the current selection.  The returned slice is only
+// valid until the next call to a method other than Offset.
+func (in *input) Lexeme() []byte {
+	return in.buf[in.start:in.pos]
+}
+
+// Shift returns the current selection and collapses it.  The returned
+// slice is only valid until the next call to a method other than
+// Offset.
+func (in *input) Shift() []byte {
+	bs := in.buf[in.start:in.pos]
+	in.start = in.pos
+	return bs
+}
+
+// Offset returns the absolute byte offset of the current position.
+func (in *input) Offset() int {
+	return in.base + in.pos
+}
+
+// Buffered returns all of the buffered input from the current
+// position onwards.  The returned slice is only valid until the next
+// call to a method other than Offset.
+func (in *input) Buffered() []byte {
+	return in.buf[in.pos:]
+}
+
+// Position returns the source position of the absolute offset off,
+// which must not precede the start of the current selection.
+func (in *input) Position(off int) ast.Position {
+	if off <= in.base+in.start {
+		in.advanceMark(off)
+		return in.mark
+	}
+	pos, _ := in.scan(off)
+	return pos
+}
+
+func (in *input) advanceMark(off int) {
+	if off > in.mark.Offset {
+		in.mark, in.markCR = in.scan(off)
+	}
+}
+
+func (in *input) scan(off int) (ast.Position, bool) {
+	pos, cr := in.mark, in.markCR
+	bs := in.buf[pos.Offset-in.base : off-in.base]
+	for len(bs) > 0 {
+		r, n := utf8.DecodeRune(bs)
+		switch {
+		case r == '\n' && cr:
+		case r == '\r', r == '\n', r == '\v', r == '\f',
+			r == '\u0085', r == '\u2028', r == '\u2029':
+			pos.Line++
+			pos.Column = 0
+			fallthrough
+		default:
+			pos.Column++
+		}
+		cr = r == '\r'
+		pos.Offset += n
+		bs = bs[n:]
+	}
+	return pos, cr
+}
+
+// Returned by a sizeLimiter when the underlying reader has more data
+// than permitted
+var errInputSize = errors.New("input size limit exceeded")
+
+// sizeLimiter reads from r until n bytes remain, after which it
+// returns io.EOF if r is exhausted and errInputSize otherwise.
+type sizeLimiter struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.n > 0 {
+		if int64(len(p)) > l.n {
+			p = p[:l.n]
+		}
+		n, err := l.r.Read(p)
+		l.n -= int64(n)
+		return n, err
+	}
+
+	/* Probe for a byte past the limit */
+	var b [1]byte
+	for {
+		n, err := l.r.Read(b[:])
+		switch {
+		case n > 0:
+			return 0, errInputSize
+		case err != nil:
+			return 0, err
+		}
+	}
+}
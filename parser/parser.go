@@ -6,37 +6,55 @@
 package parser
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"strings"
-	"unicode"
-
-	"github.com/tdewolff/parse/v2"
-	"github.com/tdewolff/parse/v2/css"
-	"github.com/tdewolff/parse/v2/js"
 
 	"git.thomasvoss.com/gsp/v4/ast"
 )
 
-var tagToType = map[string]ast.NodeType{
-	"area":     ast.Void,
-	"base":     ast.Void,
-	"br":       ast.Void,
-	"col":      ast.Void,
-	"embed":    ast.Void,
-	"hr":       ast.Void,
-	"img":      ast.Void,
-	"input":    ast.Void,
-	"link":     ast.Void,
-	"meta":     ast.Void,
-	"param":    ast.Void,
-	"script":   ast.Raw,
-	"source":   ast.Void,
-	"style":    ast.Raw,
-	"textarea": ast.Escapable,
-	"title":    ast.Escapable,
-	"track":    ast.Void,
-	"wbr":      ast.Void,
+// Options configures the behaviour of the parser.
+type Options struct {
+	// Recover specifies whether the parser should attempt to recover
+	// from errors in the document.  When set, the parser collects
+	// every error it encounters instead of stopping at the first,
+	// and returns a best-effort AST alongside them.
+	Recover bool
+	// Trivia specifies whether the parser should record the syntactic
+	// details of the document that do not affect its meaning, such as
+	// whitespace, attribute shorthands, and string escapes, in the
+	// Trivia field of each node.  An unmodified AST parsed with trivia
+	// is written back byte-for-byte by formatter.WriteUntranslatedAST.
+	Trivia bool
+	// Elements configures how the parser treats the elements it
+	// contains, taking precedence over the default element table.
+	// Elements not present are treated as given by DefaultElements.
+	Elements map[string]Element
+	// MediaTypes maps values of the ‘type’ attribute to the lexers
+	// used to find the end of raw bodies of elements with that
+	// attribute, taking precedence over the lexer of the element.
+	// Keys must be lowercase and without parameters, as they are
+	// matched case-insensitively and with any parameters removed.
+	MediaTypes map[string]BodyLexer
+
+	// MaxDepth, MaxInputSize, MaxAttributes, and MaxTextLength limit
+	// the resources the parser may use, such that untrusted documents
+	// can be parsed safely.  A limit of zero means no limit.  Exceeding
+	// a limit stops parsing even if the parser is recovering from
+	// errors, and is reported as a DepthLimitError, InputSizeError,
+	// AttributeLimitError, or TextLengthError respectively.
+
+	// MaxDepth is the maximum depth to which nodes may be nested.
+	// Top-level nodes have a depth of 1, and each comment counts as an
+	// additional level of nesting.
+	MaxDepth int
+	// MaxInputSize is the maximum size of the document in bytes.
+	MaxInputSize int64
+	// MaxAttributes is the maximum number of attributes of a single
+	// node, counting each shorthand ID and class separately.
+	MaxAttributes int
+	// MaxTextLength is the maximum length in bytes of a single run of
+	// text, raw body, or attribute value, as written in the source.
+	MaxTextLength int
 }
 
 // Parse reads GSP markup from the provided io.Reader and parses it
@@ -50,460 +68,58 @@ var tagToType = map[string]ast.NodeType{
 // provided reader is connected to a file, or "-" if the reader is
 // connected to the standard input.
 func Parse(r io.Reader, path string) ([]ast.Node, error) {
-	in := parse.NewInput(r)
-	var nodes []ast.Node
-
-	for {
-		switch err := skipSpaces(in); {
-		case err == io.EOF:
-			return nodes, nil
-		case err != nil:
-			return []ast.Node{}, err
-		}
-
-		n, err := parseNode(in)
-		if err == io.EOF {
-			return []ast.Node{}, EOFError{}
-		}
-		if err != nil {
-			switch err.(type) {
-			case InvalidEscapeError:
-				e := err.(InvalidEscapeError)
-				e.Where.Path = path
-				err = e
-			case InvalidSyntaxError:
-				e := err.(InvalidSyntaxError)
-				e.Where.Path = path
-				err = e
-			case VoidHasChildrenError:
-				e := err.(VoidHasChildrenError)
-				e.Where.Path = path
-				err = e
-			}
-			return []ast.Node{}, err
-		}
-		nodes = append(nodes, n)
-	}
-}
-
-func parseNode(in *parse.Input) (ast.Node, error) {
-	if in.Peek(0) == '/' {
-		in.Move(1)
-		if err := skipSpaces(in); err != nil {
-			return ast.Node{}, err
-		}
-		n, err := parseNode(in)
-		if err != nil {
-			return ast.Node{}, err
-		}
-		return ast.Node{
-			Type:     ast.Comment,
-			Name:     "/",
-			Children: []ast.Node{n},
-		}, nil
-	}
-
-	name, err := parseIdent(in, false)
-	if err != nil {
-		return ast.Node{}, err
-	}
-
-	ty, ok := tagToType[name]
-	if !ok {
-		ty = ast.Normal
-	}
-
-	var kids []ast.Node
-	attrs := make(map[string][]string)
-
-outer:
-	for {
-		if err := skipSpaces(in); err != nil {
-			return ast.Node{}, err
-		}
-
-		ch, n := in.PeekRune(0)
-		if ch == 0 && in.Err() != nil {
-			return ast.Node{}, in.Err()
-		}
-
-		switch {
-		case ch == '#':
-			in.Move(n)
-			in.Skip()
-			sh, err := parseShorthand(in)
-			if err != nil {
-				return ast.Node{}, err
-			}
-			attrs["id"] = append(attrs["id"], sh)
-		case ch == '.':
-			in.Move(n)
-			in.Skip()
-			sh, err := parseShorthand(in)
-			if err != nil {
-				return ast.Node{}, err
-			}
-			attrs["class"] = append(attrs["class"], sh)
-		case validNameStartChar(ch):
-			k, v, err := parseAttribute(in)
-			if err != nil {
-				return ast.Node{}, err
-			}
-			attrs[k] = append(attrs[k], v)
-		case ch == '{':
-			in.Move(n)
-			in.Skip()
-			switch name {
-			case "style":
-				s, err := parseCSSBody(in)
-				if err != nil {
-					return ast.Node{}, err
-				}
-				kids = []ast.Node{ast.Node{
-					Type: ast.Text,
-					Name: s,
-				}}
-				break outer
-			case "script":
-				s, err := parseJSBody(in)
-				if err != nil {
-					return ast.Node{}, err
-				}
-				kids = []ast.Node{ast.Node{
-					Type: ast.Text,
-					Name: s,
-				}}
-				break outer
-			default:
-				if ch := in.Peek(0); ch == '-' || ch == '=' {
-					in.Move(1)
-					in.Skip()
-					kids, err = parseTextBlock(in, ch == '=')
-					if err != nil {
-						return ast.Node{}, err
-					}
-					break outer
-				}
-
-				for {
-					if err := skipSpaces(in); err != nil {
-						return ast.Node{}, err
-					}
-
-					ch, n := in.PeekRune(0)
-					if ch == 0 && in.Err() != nil {
-						return ast.Node{}, in.Err()
-					}
-
-					if ch == '}' {
-						in.Move(n)
-						in.Skip()
-						break outer
-					}
-
-					node, err := parseNode(in)
-					if err != nil {
-						return ast.Node{}, err
-					}
-					kids = append(kids, node)
-				}
-			}
-		default:
-			return ast.Node{}, newInvalidSyntaxError(in,
-				"node attributes or braces",
-				fmt.Sprintf("invalid character ‘%c’", ch))
-		}
-	}
-
-	if name[0] == '$' {
-		if name[1] == '$' {
-			ty = ast.VerbatimMacro
-			name = name[2:]
-		} else {
-			ty = ast.Macro
-			name = name[1:]
-		}
-	}
-
-	if ty == ast.Void && len(kids) != 0 {
-		return ast.Node{}, newVoidHasChildrenError(in, name)
-	}
-
-	return ast.Node{
-		Type:       ty,
-		Name:       name,
-		Attributes: attrs,
-		Children:   kids,
-	}, nil
-}
-
-func parseIdent(in *parse.Input, attr bool) (string, error) {
-	in.Skip()
-	r, n := in.PeekRune(0)
-	if r == 0 && in.Err() != nil {
-		return "", in.Err()
-	}
-
-	if !validNameStartChar(r) {
-		expected := "node name"
-		if attr {
-			expected = "attribute name"
-		}
-		return "", newInvalidSyntaxError(in,
-			expected,
-			fmt.Sprintf("invalid character ‘%c’", r))
-	} else if !attr && !validNameChar(r) {
-		return "", newInvalidSyntaxError(in,
-			"class/id shorthand",
-			fmt.Sprintf("invalid character ‘%c’", r))
-	}
-
-	in.Move(n)
-	for {
-		r, n = in.PeekRune(0)
-		if r == 0 && in.Err() != nil {
-			break
-		}
-		if !validNameChar(r) {
-			break
-		}
-		in.Move(n)
-	}
-
-	s := string(in.Shift())
-	if !attr && s == "$" || s == "$$" {
-		return "", newInvalidSyntaxError(in,
-			"macro name", "nothing")
-	}
-	return s, nil
-}
-
-func parseShorthand(in *parse.Input) (string, error) {
-	r, n := in.PeekRune(0)
-	if r == 0 && in.Err() != nil {
-		return "", in.Err()
-	}
-
-	if !validNameChar(r) {
-		return "", newInvalidSyntaxError(in,
-			"id/class identifier",
-			fmt.Sprintf("invalid character ‘%c’", r))
-	}
-
-	in.Move(n)
-	for {
-		r, n = in.PeekRune(0)
-		if r == 0 && in.Err() != nil {
-			break
-		}
-		if !validNameChar(r) {
-			break
-		}
-		in.Move(n)
-	}
-
-	return string(in.Shift()), nil
-}
-
-func parseAttribute(in *parse.Input) (string, string, error) {
-	k, err := parseIdent(in, true)
-	if err != nil {
-		return "", "", err
-	}
-
-	r, n := in.PeekRune(0)
-	if r == 0 && in.Err() != nil {
-		return "", "", in.Err()
-	} else if r != '=' {
-		return k, "", nil
-	}
-
-	in.Move(n)
-	in.Skip()
-
-	v, err := parseString(in)
-	if err != nil {
-		return "", "", err
-	}
-
-	return k, v, nil
-}
-
-func parseCSSBody(in *parse.Input) (string, error) {
-	off := in.Offset()
-	depth := 1
-	l := css.NewLexer(in)
-
-	for {
-		tt, _ := l.Next()
-		if tt == css.ErrorToken {
-			if l.Err() == io.EOF {
-				return "", EOFError{}
-			}
-			return "", l.Err()
-		}
-
-		if tt == css.LeftBraceToken {
-			depth++
-		} else if tt == css.RightBraceToken {
-			depth--
-			if depth == 0 {
-				s := string(in.Bytes()[off : in.Offset()-1])
-				return s, nil
-			}
-		}
-	}
+	return ParseWithOptions(r, path, Options{})
 }
 
-func parseJSBody(in *parse.Input) (string, error) {
-	off := in.Offset()
-	depth := 1
-	l := js.NewLexer(in)
-
-	for {
-		tt, _ := l.Next()
-		if tt == js.ErrorToken {
-			if l.Err() == io.EOF {
-				return "", EOFError{}
-			}
-			return "", l.Err()
-		}
-
-		if tt == js.OpenBraceToken {
-			depth++
-		} else if tt == js.CloseBraceToken {
-			depth--
-			if depth == 0 {
-				s := string(in.Bytes()[off : in.Offset()-1])
-				return s, nil
-			}
-		}
-	}
+// ParseWithOptions is like Parse but allows the behaviour of the
+// parser to be configured.
+//
+// If opts.Recover is set, the parser resynchronises at the next
+// attribute, sibling node, or brace boundary after an error.  The
+// returned AST then contains every node that could be parsed, and the
+// returned error is an ErrorList of each error encountered in
+// document order.  If the end of the file is reached while parsing
+// a node, the node is included in the AST with the children parsed so
+// far.
+func ParseWithOptions(r io.Reader, path string, opts Options) ([]ast.Node, error) {
+	return ParseContext(context.Background(), r, path, opts)
 }
 
-func parseTextBlock(in *parse.Input, untrimmed bool) ([]ast.Node, error) {
-	depth := 1
-	nodes := make([]ast.Node, 0, 8)
+// ParseContext is like ParseWithOptions but stops parsing once ctx is
+// done, in which case the returned error wraps ctx.Err().
+func ParseContext(ctx context.Context, r io.Reader, path string,
+	opts Options) ([]ast.Node, error) {
+	d := NewDecoderContext(ctx, r, path, opts)
+	var nodes []ast.Node
 
-	in.Skip()
-outer:
 	for {
-		ch := in.Peek(0)
-		in.Move(1)
-
-		switch ch {
-		case 0:
-			if in.Err() == io.EOF {
-				return []ast.Node{}, EOFError{}
-			}
-			return []ast.Node{}, in.Err()
-		case '@':
-			in.Move(-1)
-			nodes = append(nodes, ast.Node{
-				Type: ast.Text,
-				Name: string(in.Shift()),
-			})
-			in.Move(1)
-
-			if err := skipSpaces(in); err != nil {
-				return []ast.Node{}, err
-			}
-
-			n, err := parseNode(in)
-			if err != nil {
-				return []ast.Node{}, err
-			}
-			nodes = append(nodes, n)
-			in.Skip()
-		case '{':
-			depth++
-		case '}':
-			depth--
-			if depth == 0 {
-				in.Move(-1)
-				nodes = append(nodes, ast.Node{
-					Type: ast.Text,
-					Name: string(in.Shift()),
-				})
-				in.Move(1)
-				break outer
-			}
-		case '\\':
-			switch ch := in.Peek(0); ch {
-			/* Ignore escaping EOF so that we throw a syntax error instead */
-			case 0, '@', '{', '}', '\\':
-			default:
-				ch, _ := in.PeekRune(0)
-				return []ast.Node{}, newInvalidEscapeError(in, ch)
+		ev, err := d.Next()
+		if err == io.EOF {
+			if len(nodes) != 0 && nodes[len(nodes)-1].Trivia != nil {
+				nodes[len(nodes)-1].Trivia.After = d.Trailing()
 			}
-			in.Move(1)
-		}
-	}
-
-	if !untrimmed {
-		l := len(nodes) - 1
-		nodes[0].Name = strings.TrimLeftFunc(nodes[0].Name, unicode.IsSpace)
-		nodes[l].Name = strings.TrimRightFunc(nodes[l].Name, unicode.IsSpace)
-	}
-
-	return nodes, nil
-}
-
-func parseString(in *parse.Input) (string, error) {
-	r, n := in.PeekRune(0)
-	if r == 0 && in.Err() != nil {
-		return "", in.Err()
-	} else if r != '"' {
-		return "", newInvalidSyntaxError(in,
-			"double-quoted string",
-			fmt.Sprintf("‘%c’", r))
-	}
-	in.Move(n)
-	in.Skip()
-
-	var sb strings.Builder
-	for {
-		r, n := in.PeekRune(0)
-		if r == 0 && in.Err() != nil {
-			return "", in.Err()
+			return nodes, d.Err()
+		} else if err != nil {
+			return []ast.Node{}, err
 		}
-		in.Move(n)
 
-		switch r {
-		case '"':
-			in.Skip()
-			return sb.String(), nil
-		case '\\':
-			r2, n2 := in.PeekRune(0)
-			if r2 == 0 && in.Err() != nil {
-				return "", in.Err()
-			}
-			in.Move(n2)
-
-			if r2 != '\\' && r2 != '"' {
-				return "", newInvalidEscapeError(in, r2)
-			}
-			sb.WriteRune(r2)
-		default:
-			sb.WriteRune(r)
+		n, err := d.ReadNode(ev)
+		if err != nil {
+			return []ast.Node{}, err
 		}
-		in.Skip()
+		nodes = append(nodes, n)
 	}
 }
 
-func skipSpaces(in *parse.Input) error {
-	for {
-		r, n := in.PeekRune(0)
-		if r == 0 && in.Err() != nil {
-			return in.Err()
-		}
-		if unicode.IsSpace(r) {
-			in.Move(n)
-		} else {
-			in.Skip()
-			return nil
+// ValidName reports whether s is a valid node or attribute name.  The
+// names of macros are valid if they are with their leading ‘$’.
+func ValidName(s string) bool {
+	for i, r := range s {
+		if i == 0 && !validNameStartChar(r) || !validNameChar(r) {
+			return false
 		}
 	}
+	return s != ""
 }
 
 func validNameStartChar(r rune) bool {
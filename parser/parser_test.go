@@ -1,6 +1,9 @@
 package parser
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -20,9 +23,8 @@ func TestParse(t *testing.T) {
 			input: `div {}`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "div",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "div",
 				},
 			},
 		},
@@ -33,11 +35,12 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "p",
-					Attributes: map[string][]string{
-						"id":    {"my-id"},
-						"class": {"class1", "class2"},
-						"key":   {"value"},
-						"noval": {""},
+					Attributes: ast.Attributes{
+						{Key: "id", Value: "my-id"},
+						{Key: "class", Value: "class1"},
+						{Key: "class", Value: "class2"},
+						{Key: "key", Value: "value"},
+						{Key: "noval", Value: ""},
 					},
 				},
 			},
@@ -49,8 +52,8 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Void,
 					Name: "img",
-					Attributes: map[string][]string{
-						"src": {"test.png"},
+					Attributes: ast.Attributes{
+						{Key: "src", Value: "test.png"},
 					},
 				},
 			},
@@ -60,19 +63,16 @@ func TestParse(t *testing.T) {
 			input: `html { body { p {} } }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "html",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "html",
 					Children: []ast.Node{
 						{
-							Type:       ast.Normal,
-							Name:       "body",
-							Attributes: map[string][]string{},
+							Type: ast.Normal,
+							Name: "body",
 							Children: []ast.Node{
 								{
-									Type:       ast.Normal,
-									Name:       "p",
-									Attributes: map[string][]string{},
+									Type: ast.Normal,
+									Name: "p",
 								},
 							},
 						},
@@ -85,9 +85,8 @@ func TestParse(t *testing.T) {
 			input: `p {-   trimmed text   }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "p",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -102,9 +101,8 @@ func TestParse(t *testing.T) {
 			input: `pre {=   untrimmed text   }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "pre",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "pre",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -119,18 +117,16 @@ func TestParse(t *testing.T) {
 			input: `p {- Hello @em{-world}! }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "p",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
 							Name: "Hello ",
 						},
 						{
-							Type:       ast.Normal,
-							Name:       "em",
-							Attributes: map[string][]string{},
+							Type: ast.Normal,
+							Name: "em",
 							Children: []ast.Node{
 								{
 									Type: ast.Text,
@@ -151,18 +147,16 @@ func TestParse(t *testing.T) {
 			input: `p {- Hello@ em{-world}! }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "p",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
 							Name: "Hello",
 						},
 						{
-							Type:       ast.Normal,
-							Name:       "em",
-							Attributes: map[string][]string{},
+							Type: ast.Normal,
+							Name: "em",
 							Children: []ast.Node{
 								{
 									Type: ast.Text,
@@ -185,8 +179,8 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Macro,
 					Name: "date",
-					Attributes: map[string][]string{
-						"format": {"%Y"},
+					Attributes: ast.Attributes{
+						{Key: "format", Value: "%Y"},
 					},
 				},
 			},
@@ -198,8 +192,8 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.VerbatimMacro,
 					Name: "syntax_highlight",
-					Attributes: map[string][]string{
-						"lang": {"c"},
+					Attributes: ast.Attributes{
+						{Key: "lang", Value: "c"},
 					},
 					Children: []ast.Node{
 						{
@@ -220,14 +214,12 @@ func TestParse(t *testing.T) {
 					Attributes: nil,
 					Children: []ast.Node{
 						{
-							Type:       ast.Normal,
-							Name:       "div",
-							Attributes: map[string][]string{},
+							Type: ast.Normal,
+							Name: "div",
 							Children: []ast.Node{
 								{
-									Type:       ast.Normal,
-									Name:       "p",
-									Attributes: map[string][]string{},
+									Type: ast.Normal,
+									Name: "p",
 								},
 							},
 						},
@@ -240,9 +232,8 @@ func TestParse(t *testing.T) {
 			input: `style { body { /* foo */ color: red; } }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Raw,
-					Name:       "style",
-					Attributes: map[string][]string{},
+					Type: ast.Raw,
+					Name: "style",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -257,9 +248,8 @@ func TestParse(t *testing.T) {
 			input: `script { /* foo */ const a = { b: 1 }; }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Raw,
-					Name:       "script",
-					Attributes: map[string][]string{},
+					Type: ast.Raw,
+					Name: "script",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -274,9 +264,8 @@ func TestParse(t *testing.T) {
 			input: `p {- \@ \{ \} \\ }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "p",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -306,9 +295,8 @@ func TestParse(t *testing.T) {
 			input: `script { const obj = { a: "}" }; /* } */ }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Raw,
-					Name:       "script",
-					Attributes: map[string][]string{},
+					Type: ast.Raw,
+					Name: "script",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
@@ -325,9 +313,9 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Void,
 					Name: "input",
-					Attributes: map[string][]string{
-						"disabled": {""},
-						"readonly": {""},
+					Attributes: ast.Attributes{
+						{Key: "disabled", Value: ""},
+						{Key: "readonly", Value: ""},
 					},
 				},
 			},
@@ -337,18 +325,16 @@ func TestParse(t *testing.T) {
 			input: `p {- Today is @$date{} }`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
+					Type: ast.Normal,
+					Name: "p",
 					Children: []ast.Node{
 						{
 							Type: ast.Text,
 							Name: "Today is ",
 						},
 						{
-							Type:       ast.Macro,
-							Name:       "date",
-							Attributes: map[string][]string{},
+							Type: ast.Macro,
+							Name: "date",
 						},
 						{
 							Type: ast.Text,
@@ -365,9 +351,11 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "div",
-					Attributes: map[string][]string{
-						"id":    {"primary", "secondary"},
-						"class": {"btn", "btn-large"},
+					Attributes: ast.Attributes{
+						{Key: "id", Value: "primary"},
+						{Key: "id", Value: "secondary"},
+						{Key: "class", Value: "btn"},
+						{Key: "class", Value: "btn-large"},
 					},
 				},
 			},
@@ -377,16 +365,14 @@ func TestParse(t *testing.T) {
 			input: `div {-} p {=}`,
 			want: []ast.Node{
 				{
-					Type:       ast.Normal,
-					Name:       "div",
-					Attributes: map[string][]string{},
-					Children:   []ast.Node{{Type: ast.Text, Name: ""}},
+					Type:     ast.Normal,
+					Name:     "div",
+					Children: []ast.Node{{Type: ast.Text, Name: ""}},
 				},
 				{
-					Type:       ast.Normal,
-					Name:       "p",
-					Attributes: map[string][]string{},
-					Children:   []ast.Node{{Type: ast.Text, Name: ""}},
+					Type:     ast.Normal,
+					Name:     "p",
+					Children: []ast.Node{{Type: ast.Text, Name: ""}},
 				},
 			},
 		},
@@ -405,9 +391,8 @@ func TestParse(t *testing.T) {
 							Attributes: nil,
 							Children: []ast.Node{
 								{
-									Type:       ast.Normal,
-									Name:       "div",
-									Attributes: map[string][]string{},
+									Type: ast.Normal,
+									Name: "div",
 								},
 							},
 						},
@@ -422,8 +407,8 @@ func TestParse(t *testing.T) {
 				{
 					Type: ast.Normal,
 					Name: "custom-element",
-					Attributes: map[string][]string{
-						"custom-attr": {"val"},
+					Attributes: ast.Attributes{
+						{Key: "custom-attr", Value: "val"},
 					},
 				},
 			},
@@ -457,9 +442,569 @@ func TestParse(t *testing.T) {
 				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			stripSpans(got)
 			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Parse() \ngot  = %v\nwant = %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestParseSpans(t *testing.T) {
+	input := "div #x {\n\tp lang=\"en\" {-  héllo @em{=!} }\n}"
+	got, err := Parse(strings.NewReader(input), "<string>")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	pos := func(off, line, col int) ast.Position {
+		return ast.Position{Offset: off, Line: line, Column: col}
+	}
+	span := func(s, sl, sc, e, el, ec int) ast.Span {
+		return ast.Span{Start: pos(s, sl, sc), End: pos(e, el, ec)}
+	}
+
+	div := got[0]
+	p := div.Children[0]
+	tests := []struct {
+		name string
+		got  ast.Span
+		want ast.Span
+	}{
+		{"div", div.Span, span(0, 1, 1, 44, 3, 2)},
+		{"div id key", div.Attributes[0].KeySpan, span(4, 1, 5, 5, 1, 6)},
+		{"div id value", div.Attributes[0].ValueSpan, span(5, 1, 6, 6, 1, 7)},
+		{"p", p.Span, span(10, 2, 2, 42, 2, 33)},
+		{"p lang key", p.Attributes[0].KeySpan, span(12, 2, 4, 16, 2, 8)},
+		{"p lang value", p.Attributes[0].ValueSpan, span(17, 2, 9, 21, 2, 13)},
+		{"leading text", p.Children[0].Span, span(26, 2, 18, 33, 2, 24)},
+		{"em", p.Children[1].Span, span(34, 2, 25, 40, 2, 31)},
+		{"em text", p.Children[1].Children[0].Span, span(38, 2, 29, 39, 2, 30)},
+		{"trailing text", p.Children[2].Span, span(40, 2, 31, 40, 2, 31)},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s span = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func stripSpans(nodes []ast.Node) {
+	ast.Walk(nodes, func(n *ast.Node) error {
+		n.Span = ast.Span{}
+		for i := range n.Attributes {
+			n.Attributes[i].KeySpan = ast.Span{}
+			n.Attributes[i].ValueSpan = ast.Span{}
+		}
+		return nil
+	})
+}
+
+func TestParseRecover(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []ast.Node
+		errs  int
+	}{
+		{
+			name:  "Malformed attribute",
+			input: `div key= {} p {}`,
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "div",
+				},
+				{
+					Type: ast.Normal,
+					Name: "p",
+				},
+			},
+			errs: 1,
+		},
+		{
+			name:  "Malformed sibling nodes",
+			input: `ul { 1i {} li {} . {} }`,
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "ul",
+					Children: []ast.Node{
+						{
+							Type: ast.Normal,
+							Name: "li",
+						},
+					},
+				},
+			},
+			errs: 2,
+		},
+		{
+			name:  "Invalid escapes and macro names in text",
+			input: `p {- a \n b @$ {-x} c }`,
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "p",
+					Children: []ast.Node{
+						{
+							Type: ast.Text,
+							Name: `a \n b  c`,
+						},
+					},
+				},
+			},
+			errs: 2,
+		},
+		{
+			name:  "Void element with children",
+			input: `br { hr {} }`,
+			want: []ast.Node{
+				{
+					Type: ast.Void,
+					Name: "br",
+					Children: []ast.Node{
+						{
+							Type: ast.Void,
+							Name: "hr",
+						},
+					},
+				},
+			},
+			errs: 1,
+		},
+		{
+			name:  "Unexpected end of file",
+			input: `html { body { p {- Hello`,
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "html",
+					Children: []ast.Node{
+						{
+							Type: ast.Normal,
+							Name: "body",
+							Children: []ast.Node{
+								{
+									Type: ast.Normal,
+									Name: "p",
+									Children: []ast.Node{
+										{
+											Type: ast.Text,
+											Name: "Hello",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			errs: 1,
+		},
+		{
+			name:  "Stray closing brace",
+			input: "}",
+			errs:  1,
+		},
+		{
+			name:  "Stray closing brace after a node without a body",
+			input: "a }",
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "a",
+				},
+			},
+			errs: 2,
+		},
+		{
+			name:  "Stray closing brace between nodes",
+			input: "a{} } b{}",
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "a",
+				},
+				{
+					Type: ast.Normal,
+					Name: "b",
+				},
+			},
+			errs: 1,
+		},
+		{
+			name:  "Closing brace in raw text",
+			input: "script { x = /}/; }",
+			want: []ast.Node{
+				{
+					Type: ast.Raw,
+					Name: "script",
+					Children: []ast.Node{
+						{
+							Type: ast.Text,
+							Name: " x = /",
+						},
+					},
+				},
+			},
+			errs: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWithOptions(strings.NewReader(tt.input),
+				"<string>", Options{Recover: true})
+			var errs []error
+			if err != nil {
+				errs = err.(interface{ Unwrap() []error }).Unwrap()
+			}
+			if len(errs) != tt.errs {
+				t.Errorf("ParseWithOptions() errors = %v, want %d errors",
+					errs, tt.errs)
+			}
+			stripSpans(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWithOptions() \ngot  = %v\nwant = %v",
+					got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElements(t *testing.T) {
+	opts := Options{
+		Elements: map[string]Element{
+			"title":    {Type: ast.Normal},
+			"path":     {Type: ast.Void},
+			"template": {Type: ast.Raw, Lexer: LexBraces},
+		},
+		MediaTypes: map[string]BodyLexer{
+			"text/x-template": LexBraces,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []ast.Node
+		wantErr bool
+	}{
+		{
+			name:  "Overridden default element",
+			input: `title {-a @b{-c}}`,
+			want: []ast.Node{
+				{
+					Type: ast.Normal,
+					Name: "title",
+					Children: []ast.Node{
+						{Type: ast.Text, Name: "a "},
+						{
+							Type: ast.Normal,
+							Name: "b",
+							Children: []ast.Node{
+								{Type: ast.Text, Name: "c"},
+							},
+						},
+						{Type: ast.Text, Name: ""},
+					},
+				},
+			},
+		},
+		{
+			name:    "Custom void element",
+			input:   `path { g {} }`,
+			wantErr: true,
+		},
+		{
+			name:  "Custom raw element",
+			input: `template {{{x}} isn't}`,
+			want: []ast.Node{
+				{
+					Type: ast.Raw,
+					Name: "template",
+					Children: []ast.Node{
+						{Type: ast.Text, Name: "{{x}} isn't"},
+					},
+				},
+			},
+		},
+		{
+			name:  "Lexer chosen by media type",
+			input: `script type="Text/X-Template; v=1" {{{x}} isn't}`,
+			want: []ast.Node{
+				{
+					Type: ast.Raw,
+					Name: "script",
+					Attributes: ast.Attributes{
+						{Key: "type", Value: "Text/X-Template; v=1"},
+					},
+					Children: []ast.Node{
+						{Type: ast.Text, Name: "{{x}} isn't"},
+					},
+				},
+			},
+		},
+		{
+			name:  "Unknown media type",
+			input: `script type="application/ld+json" {{"a": "}"}}`,
+			want: []ast.Node{
+				{
+					Type: ast.Raw,
+					Name: "script",
+					Attributes: ast.Attributes{
+						{Key: "type", Value: "application/ld+json"},
+					},
+					Children: []ast.Node{
+						{Type: ast.Text, Name: `{"a": "}"}`},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWithOptions(strings.NewReader(tt.input),
+				"<string>", opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWithOptions() error = %v, wantErr %v",
+					err, tt.wantErr)
+			}
+			stripSpans(got)
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWithOptions() \ngot  = %v\nwant = %v",
+					got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorLocations(t *testing.T) {
+	pos := func(off, line, col int) ast.Position {
+		return ast.Position{Offset: off, Line: line, Column: col}
+	}
+
+	tests := []struct {
+		name      string
+		input     string
+		want      ast.Span
+		construct string
+		open      ast.Span
+	}{
+		{
+			name:  "Invalid escape",
+			input: "p {- a \\q }",
+			want:  ast.Span{Start: pos(7, 1, 8), End: pos(9, 1, 10)},
+		},
+		{
+			name:  "Void element with children",
+			input: "div {\n\tbr { p {} }\n}",
+			want:  ast.Span{Start: pos(7, 2, 2), End: pos(9, 2, 4)},
+		},
+		{
+			name:      "Unterminated node body",
+			input:     "div {\n\tp {}\n",
+			want:      ast.Span{Start: pos(12, 3, 1), End: pos(12, 3, 1)},
+			construct: "body of ‘div’",
+			open:      ast.Span{Start: pos(4, 1, 5), End: pos(5, 1, 6)},
+		},
+		{
+			name:      "Unterminated text body",
+			input:     "div {\n\tp {- a @em{=b}",
+			want:      ast.Span{Start: pos(21, 2, 16), End: pos(21, 2, 16)},
+			construct: "text body of ‘p’",
+			open:      ast.Span{Start: pos(9, 2, 4), End: pos(11, 2, 6)},
+		},
+		{
+			name:      "Unterminated string",
+			input:     `a href="x {}`,
+			want:      ast.Span{Start: pos(12, 1, 13), End: pos(12, 1, 13)},
+			construct: "string",
+			open:      ast.Span{Start: pos(7, 1, 8), End: pos(8, 1, 9)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input), "<string>")
+
+			var got Location
+			var eofErr EOFError
+			var escErr InvalidEscapeError
+			var voidErr VoidHasChildrenError
+			switch {
+			case errors.As(err, &eofErr):
+				got = eofErr.Where
+				if eofErr.Construct != tt.construct {
+					t.Errorf("Construct = %q, want %q",
+						eofErr.Construct, tt.construct)
+				}
+				if eofErr.Open.Span != tt.open {
+					t.Errorf("Open = %v, want %v", eofErr.Open.Span, tt.open)
+				}
+			case errors.As(err, &escErr):
+				got = escErr.Where
+			case errors.As(err, &voidErr):
+				got = voidErr.Where
+			default:
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if got.Span != tt.want {
+				t.Errorf("Span = %v, want %v", got.Span, tt.want)
+			}
+			if got.Path != "<string>" {
+				t.Errorf("Path = %q, want %q", got.Path, "<string>")
+			}
+		})
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := ParseContext(ctx, strings.NewReader("div { p{-foo} }"),
+		"x.gsp", Options{Recover: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ParseContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	pos := func(off, line, col int) ast.Position {
+		return ast.Position{Offset: off, Line: line, Column: col}
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		code  string
+		want  ast.Span
+	}{
+		{
+			name:  "Depth at limit",
+			input: "a { b {} }",
+			opts:  Options{MaxDepth: 2},
+		},
+		{
+			name:  "Depth exceeded",
+			input: "a { b { c {} } }",
+			opts:  Options{MaxDepth: 2},
+			code:  "depth-limit",
+			want:  ast.Span{Start: pos(8, 1, 9), End: pos(9, 1, 10)},
+		},
+		{
+			name:  "Depth exceeded by comment",
+			input: "a { / b {} }",
+			opts:  Options{MaxDepth: 2},
+			code:  "depth-limit",
+			want:  ast.Span{Start: pos(6, 1, 7), End: pos(7, 1, 8)},
+		},
+		{
+			name:  "Input size at limit",
+			input: "a {}",
+			opts:  Options{MaxInputSize: 4},
+		},
+		{
+			name:  "Input size exceeded",
+			input: "a {}\nb {}",
+			opts:  Options{MaxInputSize: 6},
+			code:  "input-size",
+			want:  ast.Span{Start: pos(6, 2, 2), End: pos(6, 2, 2)},
+		},
+		{
+			name:  "Attributes exceeded by shorthand",
+			input: `a x y="1" #z {}`,
+			opts:  Options{MaxAttributes: 2},
+			code:  "attribute-limit",
+			want:  ast.Span{Start: pos(10, 1, 11), End: pos(12, 1, 13)},
+		},
+		{
+			name:  "Attributes exceeded",
+			input: `a x y="12" {}`,
+			opts:  Options{MaxAttributes: 1},
+			code:  "attribute-limit",
+			want:  ast.Span{Start: pos(4, 1, 5), End: pos(10, 1, 11)},
+		},
+		{
+			name:  "Text length exceeded",
+			input: "p {- abcdef }",
+			opts:  Options{MaxTextLength: 4},
+			code:  "text-length",
+			want:  ast.Span{Start: pos(8, 1, 9), End: pos(9, 1, 10)},
+		},
+		{
+			name:  "Raw body length exceeded",
+			input: "style { abcdef }",
+			opts:  Options{MaxTextLength: 4},
+			code:  "text-length",
+			want:  ast.Span{Start: pos(11, 1, 12), End: pos(12, 1, 13)},
+		},
+		{
+			name:  "Attribute value at limit",
+			input: `a x="abcd" {}`,
+			opts:  Options{MaxTextLength: 4},
+		},
+		{
+			name:  "Attribute value length exceeded",
+			input: `a x="abcdef" {}`,
+			opts:  Options{MaxTextLength: 4},
+			code:  "text-length",
+			want:  ast.Span{Start: pos(9, 1, 10), End: pos(10, 1, 11)},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, recover := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/recover=%v", tt.name, recover), func(t *testing.T) {
+				opts := tt.opts
+				opts.Recover = recover
+				_, err := ParseWithOptions(strings.NewReader(tt.input),
+					"<string>", opts)
+
+				if tt.code == "" {
+					if err != nil {
+						t.Fatalf("ParseWithOptions() error = %v", err)
+					}
+					return
+				}
+
+				var pe Error
+				if !errors.As(err, &pe) || pe.Code() != tt.code {
+					t.Fatalf("ParseWithOptions() error = %v, want code %q",
+						err, tt.code)
+				}
+				if got := pe.Position(); got.Span != tt.want {
+					t.Errorf("Span = %v, want %v", got.Span, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"p", true},
+		{"xml:lang", true},
+		{"data-x.y", true},
+		{"$macro", true},
+		{"", false},
+		{"-x", false},
+		{"1x", false},
+		{"p onclick", false},
+		{"x>", false},
+	}
+	for _, tt := range tests {
+		if got := ValidName(tt.name); got != tt.want {
+			t.Errorf("ValidName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}